@@ -0,0 +1,293 @@
+package response
+
+import (
+	"github.com/suboat/go-response/log"
+	"github.com/suboat/go-response/session"
+
+	"encoding/json"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// 环境变量前缀, 如RESPONSE_SESSION_KEY
+	ConfigEnvPrefix = "RESPONSE_"
+)
+
+// 可读写的时长, 如"72h", "15m"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(b, &s); err != nil {
+		return
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var s string
+	if err = unmarshal(&s); err != nil {
+		return
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return
+}
+
+// PEM签名钥匙
+type ConfigKey struct {
+	Id      string `json:"id" yaml:"id"`
+	Alg     string `json:"alg" yaml:"alg"`         // RS256, ES256
+	Private string `json:"private" yaml:"private"` // 私钥文件, 为空则只用于验证
+	Public  string `json:"public" yaml:"public"`   // 公钥文件, 为空则从私钥导出
+}
+
+// 配置: 取代写死的秘钥与全局变量
+type Config struct {
+	Dev bool `json:"dev" yaml:"dev"` // 开发模式: 允许默认秘钥
+
+	// session
+	SessionKey      string      `json:"sessionKey" yaml:"sessionKey"`           // cookie与默认钥匙的秘钥
+	TokenKeys       []ConfigKey `json:"tokenKeys" yaml:"tokenKeys"`             // PEM签名钥匙
+	TokenKeyCurrent string      `json:"tokenKeyCurrent" yaml:"tokenKeyCurrent"` // 当前签名钥匙id, 为空则用默认钥匙
+	TokenExp        Duration    `json:"tokenExp" yaml:"tokenExp"`               // token默认有效期
+	TokenExpAccess  Duration    `json:"tokenExpAccess" yaml:"tokenExpAccess"`   // 访问token有效期
+	TokenExpRefresh Duration    `json:"tokenExpRefresh" yaml:"tokenExpRefresh"` // 刷新token有效期
+	TokenExpPay     Duration    `json:"tokenExpPay" yaml:"tokenExpPay"`         // 支付级别token有效期
+	RevokeFile      string      `json:"revokeFile" yaml:"revokeFile"`           // 作废记录文件, 为空则存在内存
+	SessionFile     string      `json:"sessionFile" yaml:"sessionFile"`         // 服务端会话文件, 为空则存在内存
+
+	// cors
+	AllowCors     bool     `json:"allowCors" yaml:"allowCors"`
+	AllowCorsHost []string `json:"allowCorsHost" yaml:"allowCorsHost"`
+
+	// websocket
+	WsWriteWait       Duration `json:"wsWriteWait" yaml:"wsWriteWait"`
+	WsPongWait        Duration `json:"wsPongWait" yaml:"wsPongWait"`
+	WsMaxMessageSize  int64    `json:"wsMaxMessageSize" yaml:"wsMaxMessageSize"`
+	WsReadBufferSize  int      `json:"wsReadBufferSize" yaml:"wsReadBufferSize"`
+	WsWriteBufferSize int      `json:"wsWriteBufferSize" yaml:"wsWriteBufferSize"`
+}
+
+// 读配置: 先取默认值, 再读文件(.json, .yaml, .yml), 最后读环境变量
+// path为空时只读环境变量
+func LoadConfig(path string) (c *Config, err error) {
+	var b []byte
+	c = NewConfig(nil)
+
+	if len(path) > 0 {
+		if b, err = ioutil.ReadFile(path); err != nil {
+			return
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json":
+			err = json.Unmarshal(b, c)
+			break
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(b, c)
+			break
+		default:
+			err = ErrConfigType
+			break
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	err = c.LoadEnv()
+	return
+}
+
+// 从环境变量覆盖配置
+func (c *Config) LoadEnv() (err error) {
+	var (
+		s  string
+		ok bool
+	)
+	env := func(key string) (string, bool) {
+		return os.LookupEnv(ConfigEnvPrefix + key)
+	}
+	if s, ok = env("DEV"); ok {
+		if c.Dev, err = strconv.ParseBool(s); err != nil {
+			return
+		}
+	}
+	if s, ok = env("SESSION_KEY"); ok {
+		c.SessionKey = s
+	}
+	if s, ok = env("TOKEN_KEY_CURRENT"); ok {
+		c.TokenKeyCurrent = s
+	}
+	if s, ok = env("REVOKE_FILE"); ok {
+		c.RevokeFile = s
+	}
+	if s, ok = env("SESSION_FILE"); ok {
+		c.SessionFile = s
+	}
+	if s, ok = env("ALLOW_CORS"); ok {
+		if c.AllowCors, err = strconv.ParseBool(s); err != nil {
+			return
+		}
+	}
+	if s, ok = env("ALLOW_CORS_HOST"); ok {
+		c.AllowCorsHost = []string{}
+		for _, h := range strings.Split(s, ",") {
+			if h = strings.TrimSpace(h); len(h) > 0 {
+				c.AllowCorsHost = append(c.AllowCorsHost, h)
+			}
+		}
+	}
+	if s, ok = env("WS_MAX_MESSAGE_SIZE"); ok {
+		if c.WsMaxMessageSize, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return
+		}
+	}
+	for key, d := range map[string]*Duration{
+		"TOKEN_EXP":         &c.TokenExp,
+		"TOKEN_EXP_ACCESS":  &c.TokenExpAccess,
+		"TOKEN_EXP_REFRESH": &c.TokenExpRefresh,
+		"TOKEN_EXP_PAY":     &c.TokenExpPay,
+		"WS_WRITE_WAIT":     &c.WsWriteWait,
+		"WS_PONG_WAIT":      &c.WsPongWait,
+	} {
+		if s, ok = env(key); ok {
+			if d.Duration, err = time.ParseDuration(s); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// 检查配置
+func (c *Config) Valid() (err error) {
+	if len(c.SessionKey) == 0 {
+		err = ErrConfigSessionKey
+		return
+	}
+	// 非开发模式不能使用默认秘钥
+	if c.Dev == false && c.SessionKey == session.SessionKeyDefault {
+		err = ErrConfigSessionKey
+		return
+	}
+	if c.WsPongWait.Duration <= 0 || c.WsWriteWait.Duration <= 0 || c.WsMaxMessageSize <= 0 ||
+		c.WsReadBufferSize < 0 || c.WsWriteBufferSize < 0 {
+		err = ErrConfigValue
+		return
+	}
+	if c.TokenExp.Duration <= 0 || c.TokenExpAccess.Duration <= 0 || c.TokenExpPay.Duration <= 0 ||
+		c.TokenExpRefresh.Duration < c.TokenExpAccess.Duration {
+		err = ErrConfigValue
+		return
+	}
+	return
+}
+
+// 应用配置到各个包: 先建好并检查全部内容, 出错时不改变现有配置
+func (c *Config) Apply() (err error) {
+	var (
+		k      *session.Key
+		rs     *session.RevokeStoreFile
+		rg     *session.SessionRegistryFile
+		keySet = session.NewKeySet(nil)
+	)
+	if err = c.Valid(); err != nil {
+		return
+	}
+	if c.Dev {
+		log.Warn("config: dev mode")
+	}
+
+	// session: 新的钥匙集, 不修改正在使用的
+	keySet.Add(session.NewKeyHmac(session.TokenKeyIdDefault, []byte(c.SessionKey)))
+	keySet.Legacy = session.TokenKeyIdDefault
+	for _, ck := range c.TokenKeys {
+		if k, err = session.LoadKeyPem(ck.Id, ck.Alg, ck.Private, ck.Public); err != nil {
+			return
+		}
+		if err = keySet.Add(k); err != nil {
+			return
+		}
+	}
+	if len(c.TokenKeyCurrent) > 0 {
+		if err = keySet.Use(c.TokenKeyCurrent); err != nil {
+			return
+		}
+	}
+	if len(c.RevokeFile) > 0 {
+		if rs, err = session.NewRevokeStoreFile(c.RevokeFile); err != nil {
+			return
+		}
+	}
+	if len(c.SessionFile) > 0 {
+		if rg, err = session.NewSessionRegistryFile(c.SessionFile); err != nil {
+			return
+		}
+	}
+
+	// 以下不再出错, 一并替换
+	session.TokenExpDefault = c.TokenExp.Duration
+	session.TokenExpAccess = c.TokenExpAccess.Duration
+	session.TokenExpRefresh = c.TokenExpRefresh.Duration
+	session.TokenExpPay = c.TokenExpPay.Duration
+	if err = session.SetSessionKeySet(c.SessionKey, keySet); err != nil {
+		return
+	}
+	if rs != nil {
+		session.TokenRevokeStore = rs
+	}
+	if rg != nil {
+		session.SessionRegistry = rg
+	}
+
+	// cors
+	AllowCors = c.AllowCors
+	AllowCorsHost = c.AllowCorsHost
+
+	// websocket
+	WsWriteWait = c.WsWriteWait.Duration
+	WsPongWait = c.WsPongWait.Duration
+	WsPingPeriod = (WsPongWait * 9) / 10
+	WsMaxMessageSize = c.WsMaxMessageSize
+	WsUpgrader.ReadBufferSize = c.WsReadBufferSize
+	WsUpgrader.WriteBufferSize = c.WsWriteBufferSize
+	return
+}
+
+// new one: 默认值取当前全局变量
+func NewConfig(c *Config) (n *Config) {
+	// placehold
+	if c != nil {
+		n = c
+		return
+	}
+
+	n = &Config{
+		SessionKey:        session.SessionKey,
+		TokenExp:          Duration{session.TokenExpDefault},
+		TokenExpAccess:    Duration{session.TokenExpAccess},
+		TokenExpRefresh:   Duration{session.TokenExpRefresh},
+		TokenExpPay:       Duration{session.TokenExpPay},
+		AllowCors:         AllowCors,
+		AllowCorsHost:     AllowCorsHost,
+		WsWriteWait:       Duration{WsWriteWait},
+		WsPongWait:        Duration{WsPongWait},
+		WsMaxMessageSize:  WsMaxMessageSize,
+		WsReadBufferSize:  WsUpgrader.ReadBufferSize,
+		WsWriteBufferSize: WsUpgrader.WriteBufferSize,
+	}
+	return
+}
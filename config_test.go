@@ -0,0 +1,73 @@
+package response
+
+import (
+	"github.com/suboat/go-response/session"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_LoadConfig(t *testing.T) {
+	var (
+		dir, _ = ioutil.TempDir("", "config")
+		path   = filepath.Join(dir, "config.yaml")
+		c      *Config
+		err    error
+	)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path, []byte("tokenExp: 1h\nallowCorsHost: [\"https://a.example.com\"]\n"), 0600)
+	os.Setenv(ConfigEnvPrefix+"WS_PONG_WAIT", "30s")
+	defer os.Unsetenv(ConfigEnvPrefix + "WS_PONG_WAIT")
+
+	if c, err = LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if c.TokenExp.Duration != time.Hour || c.WsPongWait.Duration != 30*time.Second || len(c.AllowCorsHost) != 1 {
+		t.Fatal("config: ", c)
+	}
+	// 默认秘钥只能用于开发模式
+	if err = c.Valid(); err != ErrConfigSessionKey {
+		t.Fatal("default key: ", err)
+	}
+	c.Dev = true
+	if err = c.Valid(); err != nil {
+		t.Fatal(err)
+	}
+	c.Dev = false
+	c.SessionKey = session.SessionKeyDefault + "x"
+	if err = c.Valid(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 出错时不改变现有配置
+func Test_ConfigApplyAtomic(t *testing.T) {
+	var (
+		c      = NewConfig(nil)
+		key    = session.SessionKey
+		keySet = session.TokenKeySet
+		exp    = session.TokenExpDefault
+		err    error
+	)
+	c.SessionKey = "apply-atomic"
+	c.TokenExp = Duration{time.Minute}
+	c.TokenKeys = []ConfigKey{{Id: "missing", Alg: "RS256", Private: "/nonexistent/key.pem"}}
+	if err = c.Apply(); err == nil {
+		t.Fatal("apply with missing key file")
+	}
+	if session.SessionKey != key || session.TokenKeySet != keySet || session.TokenExpDefault != exp {
+		t.Fatal("partially applied")
+	}
+	if _, err = keySet.Lookup(session.TokenKeyIdDefault); err != nil {
+		t.Fatal(err)
+	}
+
+	c.TokenKeys = nil
+	c.TokenExpPay = Duration{0}
+	if err = c.Apply(); err != ErrConfigValue {
+		t.Fatal("token exp: ", err)
+	}
+}
@@ -0,0 +1,222 @@
+package response
+
+import (
+	"github.com/suboat/go-response/log"
+	"github.com/suboat/go-response/session"
+
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// 默认允许的方法与头
+	CorsMethodsDefault = []string{"DELETE", "GET", "HEAD", "OPTIONS", "POST", "PUT", "QUERY", "UNLOCK", "UPDATE"}
+	CorsHeadersDefault = []string{"Origin", "X-Requested-With", "Content-Type", "Accept", "Authorization", RequestCrudMethodTag, session.CsrfHeader}
+
+	// 未设置路由策略时使用, 为nil则由AllowCorsHost生成
+	CorsPolicyDefault *CorsPolicy
+
+	corsHostPolicy *CorsPolicy // AllowCorsHost生成的策略
+	corsHostLock   = new(sync.Mutex)
+)
+
+// 请求context中标记已处理cors
+type corsCtxKey struct{}
+
+// CORS策略
+type CorsPolicy struct {
+	// 允许的来源:
+	// 精确 https://a.example.com
+	// 子域通配 https://*.example.com, 与精确规则一样按端口匹配: 非默认端口需写明, 如 https://*.example.com:8443
+	// 正则 以^开头, 如 ^https://.*\.example\.com(:\d+)?$
+	// 任意 *, 此时不允许携带凭证
+	AllowOrigins     []string
+	AllowMethods     []string
+	AllowHeaders     []string
+	ExposeHeaders    []string
+	MaxAge           time.Duration // 预检结果缓存时间
+	AllowCredentials bool          // 允许携带cookie
+
+	// 第一次使用时编译, 之后修改AllowOrigins无效
+	once    sync.Once
+	any     bool
+	exact   map[string]bool
+	suffix  []corsSuffix
+	regexps []*regexp.Regexp
+}
+
+// 子域通配
+type corsSuffix struct {
+	scheme string
+	suffix string // .example.com
+	port   string // 为空时只匹配不带端口的来源
+}
+
+// 编译来源规则
+func (p *CorsPolicy) compile() {
+	p.exact = make(map[string]bool)
+	for _, o := range p.AllowOrigins {
+		switch {
+		case o == "*":
+			p.any = true
+		case strings.HasPrefix(o, "^"):
+			if r, err := regexp.Compile(o); err != nil {
+				log.Error("cors origin regexp: ", o, " ", err)
+			} else {
+				p.regexps = append(p.regexps, r)
+			}
+		case strings.Contains(o, "://*."):
+			i := strings.Index(o, "://*.")
+			s := corsSuffix{scheme: strings.ToLower(o[:i]), suffix: strings.ToLower(strings.TrimRight(o[i+4:], "/"))}
+			if j := strings.LastIndex(s.suffix, ":"); j >= 0 {
+				s.suffix, s.port = s.suffix[:j], s.suffix[j+1:]
+			}
+			p.suffix = append(p.suffix, s)
+		default:
+			p.exact[strings.ToLower(strings.TrimRight(o, "/"))] = true
+		}
+	}
+}
+
+// 来源是否被允许
+func (p *CorsPolicy) AllowOrigin(origin string) bool {
+	p.once.Do(p.compile)
+	if len(origin) == 0 {
+		return false
+	}
+	if p.any {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.exact[origin] {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && len(u.Host) > 0 {
+		for _, s := range p.suffix {
+			if u.Scheme == s.scheme && u.Port() == s.port && strings.HasSuffix(u.Hostname(), s.suffix) {
+				return true
+			}
+		}
+	}
+	for _, r := range p.regexps {
+		if r.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// 写CORS头, 返回是否为预检请求; 预检请求不应再交给handler
+func (p *CorsPolicy) Apply(rw http.ResponseWriter, req *http.Request) (preflight bool) {
+	var (
+		origin = req.Header.Get("Origin")
+		h      = rw.Header()
+	)
+	preflight = req.Method == RequestCrudOptions && len(req.Header.Get("Access-Control-Request-Method")) > 0
+	h.Add("Vary", "Origin")
+	if len(origin) == 0 || p.AllowOrigin(origin) == false {
+		if len(origin) > 0 {
+			log.Debug("cors origin rejected: ", origin)
+		}
+		return
+	}
+
+	if p.any && p.AllowCredentials == false {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.AllowCredentials && p.any == false {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(p.ExposeHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(p.ExposeHeaders, ", "))
+	}
+
+	if preflight {
+		methods, headers := p.AllowMethods, p.AllowHeaders
+		if len(methods) == 0 {
+			methods = CorsMethodsDefault
+		}
+		if len(headers) == 0 {
+			headers = CorsHeadersDefault
+		}
+		h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		if p.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge/time.Second)))
+		}
+	}
+	return
+}
+
+// 包装handler: 先按策略处理cors与预检, 再交给handler
+func (p *CorsPolicy) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if CorsServe(p, rw, req) {
+			return
+		}
+		h.ServeHTTP(rw, CorsHandled(req))
+	})
+}
+
+// 按策略处理cors, 返回true表示已答复预检请求
+// p为nil时使用CorsDefault(), 未开启AllowCors时不处理
+func CorsServe(p *CorsPolicy, rw http.ResponseWriter, req *http.Request) (done bool) {
+	if p == nil {
+		if p = CorsDefault(); p == nil {
+			return
+		}
+	}
+	if p.Apply(rw, req) {
+		rw.WriteHeader(http.StatusNoContent)
+		done = true
+	}
+	return
+}
+
+// websocket升级时检查来源: 无Origin或同源时允许, 否则按策略
+// p为nil时只允许同源; 拒绝的来源写日志
+func (p *CorsPolicy) CheckOrigin(req *http.Request) (ok bool) {
+	origin := req.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, req.Host) {
+		return true
+	}
+	if ok = p != nil && p.AllowOrigin(origin); ok == false {
+		log.Warn("ws origin rejected: ", origin, " ", req.RemoteAddr, " ", req.URL.Path)
+	}
+	return
+}
+
+// 标记请求已处理cors, SerializeHttp不再重复处理
+func CorsHandled(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), corsCtxKey{}, true))
+}
+
+// 默认策略: CorsPolicyDefault, 否则由AllowCorsHost生成; 未开启AllowCors时为nil
+func CorsDefault() (p *CorsPolicy) {
+	if AllowCors == false {
+		return
+	}
+	if CorsPolicyDefault != nil {
+		return CorsPolicyDefault
+	}
+	corsHostLock.Lock()
+	defer corsHostLock.Unlock()
+	if corsHostPolicy == nil || strings.Join(corsHostPolicy.AllowOrigins, ",") != strings.Join(AllowCorsHost, ",") {
+		corsHostPolicy = &CorsPolicy{
+			AllowOrigins:     append([]string{}, AllowCorsHost...),
+			AllowCredentials: true,
+		}
+	}
+	return corsHostPolicy
+}
@@ -0,0 +1,87 @@
+package response
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_CorsPolicy(t *testing.T) {
+	var p = &CorsPolicy{
+		AllowOrigins:     []string{"https://a.example.com", "https://*.sub.example.com", `^http://localhost(:\d+)?$`},
+		AllowCredentials: true,
+		MaxAge:           time.Minute,
+	}
+	for origin, ok := range map[string]bool{
+		"https://a.example.com":          true,
+		"https://b.example.com":          false,
+		"https://x.sub.example.com":      true,
+		"http://x.sub.example.com":       false,
+		"https://evilsub.example.com":    false,
+		"http://localhost:8080":          true,
+		"http://localhost.evil.com":      false,
+		"https://x.sub.example.com:8443": false,
+	} {
+		if p.AllowOrigin(origin) != ok {
+			t.Fatal("origin: ", origin)
+		}
+	}
+	// 带端口的通配
+	p2 := &CorsPolicy{AllowOrigins: []string{"https://*.example.com:8443"}}
+	for origin, ok := range map[string]bool{
+		"https://a.example.com:8443": true,
+		"https://a.example.com":      false,
+		"https://a.example.com:9443": false,
+	} {
+		if p2.AllowOrigin(origin) != ok {
+			t.Fatal("origin: ", origin)
+		}
+	}
+
+	// 预检在handler之前答复
+	var called bool
+	h := p.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { called = true }))
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("OPTIONS", "/", nil)
+	req.Header.Set("Origin", "https://a.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	h.ServeHTTP(rw, req)
+	if called || rw.Code != http.StatusNoContent || rw.Header().Get("Access-Control-Allow-Origin") != "https://a.example.com" ||
+		rw.Header().Get("Access-Control-Max-Age") != "60" {
+		t.Fatal("preflight: ", called, rw.Code, rw.Header())
+	}
+
+	// 不允许的来源不回显
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	h.ServeHTTP(rw, req)
+	if called == false || len(rw.Header().Get("Access-Control-Allow-Origin")) > 0 {
+		t.Fatal("reject: ", rw.Header())
+	}
+}
+
+func Test_CorsCheckOrigin(t *testing.T) {
+	p := &CorsPolicy{AllowOrigins: []string{"https://*.example.com"}}
+	for origin, ok := range map[string]bool{
+		"":                      true, // 非浏览器
+		"http://api.local":      true, // 同源
+		"https://a.example.com": true,
+		"https://evil.com":      false,
+	} {
+		req := httptest.NewRequest("GET", "http://api.local/ws", nil)
+		if len(origin) > 0 {
+			req.Header.Set("Origin", origin)
+		}
+		if p.CheckOrigin(req) != ok {
+			t.Fatal("origin: ", origin)
+		}
+	}
+	// 未设置策略只允许同源
+	req := httptest.NewRequest("GET", "http://api.local/ws", nil)
+	req.Header.Set("Origin", "https://a.example.com")
+	if (*CorsPolicy)(nil).CheckOrigin(req) {
+		t.Fatal("nil policy")
+	}
+}
@@ -0,0 +1,45 @@
+package response
+
+import (
+	"github.com/suboat/go-response/session"
+
+	"net/http"
+)
+
+const (
+	// 返回data中csrf token的字段名
+	ResponseTagCsrfToken = "csrfToken"
+)
+
+// 下发csrf token: GET后data为{"csrfToken": "..."}, 同时写在头session.CsrfHeader
+// 客户端之后的非安全请求须带该头; 只用于http
+type CsrfHandler struct{}
+
+func (h *CsrfHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var (
+		res   = new(Response)
+		token string
+	)
+	defer func() {
+		CreateResponse(rw, req, res)
+	}()
+
+	if token, res.Error = session.CsrfToken(rw, req); res.Error != nil {
+		return
+	}
+	rw.Header().Set(session.CsrfHeader, token)
+	res.Data = map[string]string{ResponseTagCsrfToken: token}
+	return
+}
+
+// websocket不需要csrf token
+func (h *CsrfHandler) ServeLogic(req *Request) (res *Response) {
+	res = NewResponse(req)
+	res.Error = ErrRequestSupport
+	return
+}
+
+// new one
+func NewCsrfHandler() *CsrfHandler {
+	return new(CsrfHandler)
+}
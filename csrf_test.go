@@ -0,0 +1,66 @@
+package response
+
+import (
+	"github.com/suboat/go-response/session"
+
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_Csrf(t *testing.T) {
+	var (
+		rw      = httptest.NewRecorder()
+		req     = httptest.NewRequest("POST", "/login", nil)
+		cookies []*http.Cookie
+		token   string
+		err     error
+	)
+	if err = session.HttpSessionLogin(rw, req, "csrf", session.SessionLevelNormal); err != nil {
+		t.Fatal(err)
+	}
+	cookies = rw.Result().Cookies()
+	newReq := func(method string) *http.Request {
+		r := httptest.NewRequest(method, "/item", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		return r
+	}
+
+	// 取token
+	rw = httptest.NewRecorder()
+	NewCsrfHandler().ServeHTTP(rw, newReq("GET"))
+	if token = rw.Header().Get(session.CsrfHeader); len(token) == 0 {
+		t.Fatal("no csrf token: ", rw.Body.String())
+	}
+
+	// 安全方法不检查
+	if _, err = SerializeHttp(httptest.NewRecorder(), newReq("GET")); err != nil {
+		t.Fatal(err)
+	}
+	// cookie会话的POST须带token
+	if _, err = SerializeHttp(httptest.NewRecorder(), newReq("POST")); err != session.ErrSessionCsrf {
+		t.Fatal("missing token: ", err)
+	}
+	req = newReq("POST")
+	req.Header.Set(session.CsrfHeader, "bad")
+	if _, err = SerializeHttp(httptest.NewRecorder(), req); err != session.ErrSessionCsrf {
+		t.Fatal("bad token: ", err)
+	}
+	req = newReq("DELETE")
+	req.Header.Set(session.CsrfHeader, token)
+	if _, err = SerializeHttp(httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+	// 以头改写方法同样检查
+	req = newReq("GET")
+	req.Header.Set(RequestCrudMethodTag, "DELETE")
+	if _, err = SerializeHttp(httptest.NewRecorder(), req); err != session.ErrSessionCsrf {
+		t.Fatal("method override: ", err)
+	}
+	// 无cookie的请求不检查
+	if _, err = SerializeHttp(httptest.NewRecorder(), httptest.NewRequest("POST", "/item", nil)); err != nil {
+		t.Fatal(err)
+	}
+}
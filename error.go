@@ -12,4 +12,10 @@ var (
 	ErrImageType          error = errors.New("Type of file is not image")           // sometext
 	ErrPermission         error = errors.New("error Permission")                    // sometext
 	ErrSocketConnHubEmpty error = errors.New("ws-hub in socket conn struct is nil") // sometext
+	ErrSocketHubClosed    error = errors.New("ws-hub is closed")
+	ErrSocketTopicDenied  error = errors.New("ws topic subscribe denied")
+	ErrSocketPollGone     error = errors.New("ws poll connection gone")                // 重新轮询, 不带cid
+	ErrConfigType         error = errors.New("config file type unsupport")             // json, yaml
+	ErrConfigSessionKey   error = errors.New("config session key is empty or default") // 非开发模式不能用默认秘钥
+	ErrConfigValue        error = errors.New("config value error")                     // sometext
 )
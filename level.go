@@ -0,0 +1,79 @@
+package response
+
+import (
+	"github.com/suboat/go-response/log"
+	"github.com/suboat/go-response/session"
+
+	"time"
+)
+
+// 要求会话级别的逻辑处理单元, http与websocket通用
+// 会话须含level中的全部级别, 否则返回ErrPermission
+// 含SessionLevelPay时, 处理成功后支付授权作废, 同一授权重放被拒绝
+func LevelRequired(level uint, h LogicHandler) LogicHandler {
+	return func(req *Request) (res *Response) {
+		var se = req.Session
+		if se == nil || se.Secure&level != level {
+			res = NewResponse(req)
+			res.Error = ErrPermission
+			return
+		}
+		if level&session.SessionLevelPay == 0 {
+			return h(req)
+		}
+
+		// 一次性支付授权: 先占用, 成功后作废, 失败后释放
+		if err := session.PayReserve(se); err != nil {
+			res = NewResponse(req)
+			res.Error = err
+			return
+		}
+		res = h(req)
+		if res != nil && res.Error == nil {
+			if err := session.PayCommit(se); err != nil {
+				res.Error = err
+			}
+		} else if err := session.PayRelease(se); err != nil {
+			log.Error("PayRelease: ", err)
+		}
+		return
+	}
+}
+
+// 用Request.Password提升会话级别的逻辑处理单元
+// http: 返回短期token; websocket: 同时更新当前连接的会话
+func ElevateHandler(level uint) LogicHandler {
+	return func(req *Request) (res *Response) {
+		var se *session.Session
+		res = NewResponse(req)
+		if se, res.Error = session.Elevate(req.Session, req.Password, level); res.Error != nil {
+			return
+		}
+		elevateResponse(res, se)
+		return
+	}
+}
+
+// 用totp验证码(Request.VerifyCode)提升为SessionLevelTotp的逻辑处理单元
+func TotpHandler(req *Request) (res *Response) {
+	var se *session.Session
+	res = NewResponse(req)
+	if se, res.Error = session.TotpElevate(req.Session, req.VerifyCode); res.Error != nil {
+		return
+	}
+	elevateResponse(res, se)
+	return
+}
+
+// 为提升后的会话签发短期token
+func elevateResponse(res *Response, se *session.Session) {
+	var tok string
+	if tok, res.Error = session.NewSessionToken(se, nil); res.Error != nil {
+		return
+	}
+	res.Data = map[string]interface{}{
+		"token":     tok,
+		"expiresIn": int64(session.SessionTokenExp(se, nil) / time.Second),
+	}
+	res.Session = se
+}
@@ -0,0 +1,43 @@
+package response
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/suboat/go-response/session"
+
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// 请求内容不能带入会话
+func Test_LevelRequiredBody(t *testing.T) {
+	var (
+		called bool
+		res    = new(Response)
+		body   = `{"Session":{"Uid":"victim","Secure":7,"Jti":"x1"},"RemoteIp":"1.2.3.4"}`
+		que    *Request
+		err    error
+	)
+	h := NewSimpleRestHandler(LevelRequired(session.SessionLevelSecure|session.SessionLevelPay, func(req *Request) *Response {
+		called = true
+		return NewResponse(req)
+	}))
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("POST", "/pay", strings.NewReader(body)))
+	if err = json.Unmarshal(rw.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if called || res.Success || res.ErrorStr != ErrPermission.Error() {
+		t.Fatal("session from body: ", rw.Body.String())
+	}
+
+	// websocket
+	c := NewConnWs(&ConnWs{Session: new(session.Session)})
+	if que, err = SerializeHttpWs(c, websocket.TextMessage, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if que.Session == nil || len(que.Session.Uid) > 0 || que.Session.Secure != 0 || len(que.RemoteIp) > 0 {
+		t.Fatal("ws session from body: ", que.Session)
+	}
+}
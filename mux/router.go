@@ -7,7 +7,13 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+
+	"context"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // 虚拟websocket路由
@@ -100,7 +106,18 @@ type WsRouter struct {
 	Map    *wsRouterMap
 	Hub    *response.HubWs
 	Prefix string
+
+	hooks *sync.Once
+}
+
+// token作废时断开该用户的连接, 只注册一次
+func (r *WsRouter) sessionHooks() {
+	r.hooks.Do(func() {
+		session.OnRevokeUid(r.Hub.CloseUid)
+		session.OnTerminateSession(r.Hub.CloseSid)
+	})
 }
+
 type WsRoute struct {
 	Map *wsRouterMap
 	Url string
@@ -112,6 +129,9 @@ type Router struct {
 	*mux.Router
 	// socket router
 	*WsRouter
+	// cors策略, 为nil时沿用上级路由, 最后为response.CorsDefault()
+	Cors   *response.CorsPolicy
+	parent *Router
 }
 
 // inherit from mux
@@ -120,37 +140,156 @@ type Route struct {
 	*mux.Route
 	// socket router
 	*WsRoute
+	router *Router
+	cors   *corsHandler
+	policy *response.CorsPolicy
+}
+
+// 在handler之前处理cors与预检
+type corsHandler struct {
+	handler http.Handler
+	router  *Router
+	policy  *response.CorsPolicy // 路由的策略
+	methods []string             // 路由限定的方法, 不含为预检补上的OPTIONS
+}
+
+func (h *corsHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if response.CorsServe(h.Policy(), rw, req) {
+		return
+	}
+	// 非预检的OPTIONS仍按路由限定的方法
+	if req.Method == response.RequestCrudOptions && len(h.methods) > 0 && hasMethod(h.methods, req.Method) == false {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	h.handler.ServeHTTP(rw, response.CorsHandled(req))
+}
+
+func hasMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
 }
+
+// 生效的策略: 路由, 路由器, 上级路由器
+func (h *corsHandler) Policy() (p *response.CorsPolicy) {
+	if p = h.policy; p != nil {
+		return
+	}
+	for r := h.router; r != nil && p == nil; r = r.parent {
+		p = r.Cors
+	}
+	return
+}
+
 type RouteMatch struct {
 	*mux.RouteMatch
 }
 
-// 处理websocket
+// websocket入口选项
+type WsOption struct {
+	Cors        *response.CorsPolicy       // 来源策略, 为nil时沿用路由的cors策略
+	CheckOrigin func(r *http.Request) bool // 自定义来源检查, 优先于Cors
+}
+
+// 处理websocket, opt可为*WsOption
 func (r *Router) ListenAndServeWs(path string, opt interface{}) (err error) {
-	go r.WsRouter.Hub.Run()
-	r.Router.HandleFunc(path, r.ServeWebSocket)
+	var o *WsOption
+	if opt != nil {
+		var ok bool
+		if o, ok = opt.(*WsOption); ok == false {
+			err = response.ErrRequestDataType
+			return
+		}
+	}
+	r.WsRouter.sessionHooks()
+	r.Router.HandleFunc(path, func(rw http.ResponseWriter, req *http.Request) {
+		r.serveWebSocket(rw, req, o)
+	})
 	return
 }
 func (r *Router) ServeWebSocket(rw http.ResponseWriter, req *http.Request) {
+	r.serveWebSocket(rw, req, nil)
+}
+
+// 处理SSE推送: 与websocket共用hub, 只接收推送
+func (r *Router) ListenAndServeSse(path string) (err error) {
+	r.WsRouter.sessionHooks()
+	r.Router.Handle(path, &corsHandler{handler: http.HandlerFunc(r.ServeSse), router: r})
+	return
+}
+func (r *Router) ServeSse(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(rw, "Method not allowed", 405)
+		return
+	}
+	if r.Hub.Closing() {
+		http.Error(rw, "Service Unavailable", 503)
+		return
+	}
+	se, err := session.HttpSessionUid(rw, req)
+	if err != nil {
+		http.Error(rw, err.Error(), 403)
+		return
+	}
+	response.ServeSse(r.Hub, rw, req, se)
+}
+
+// 处理长轮询: 与websocket共用hub与虚拟路由
+func (r *Router) ListenAndServePoll(path string) (err error) {
+	r.WsRouter.sessionHooks()
+	r.Router.Handle(path, &corsHandler{handler: response.NewPollServer(r.Hub, r.wsLogic()), router: r})
+	return
+}
+
+// 升级时的来源检查: 选项, WsUpgrader.CheckOrigin, 路由的cors策略
+// 只用排在最前的一个: 设置了全局WsUpgrader.CheckOrigin时cors策略不再生效, 需要策略时在其中调用CorsPolicy.CheckOrigin
+func (r *Router) checkOrigin(opt *WsOption) func(req *http.Request) bool {
+	if opt != nil && opt.CheckOrigin != nil {
+		return opt.CheckOrigin
+	}
+	if response.WsUpgrader.CheckOrigin != nil {
+		return response.WsUpgrader.CheckOrigin
+	}
+	var p *response.CorsPolicy
+	if opt != nil {
+		p = opt.Cors
+	}
+	if p == nil {
+		p = (&corsHandler{router: r}).Policy()
+	}
+	if p == nil {
+		p = response.CorsDefault()
+	}
+	return p.CheckOrigin
+}
+
+func (r *Router) serveWebSocket(rw http.ResponseWriter, req *http.Request, opt *WsOption) {
 	if req.Method != "GET" {
 		http.Error(rw, "Method not allowed", 405)
 		return
 	}
 
 	var (
-		uid string
-		se  *session.Session
-		ws  *websocket.Conn
-		c   *response.ConnWs
-		err error
+		uid      string
+		se       *session.Session
+		ws       *websocket.Conn
+		c        *response.ConnWs
+		err      error
+		upgrader = response.WsUpgrader
 	)
+	upgrader.CheckOrigin = r.checkOrigin(opt)
 
-	if ws, err = response.WsUpgrader.Upgrade(rw, req, nil); err != nil {
-		log.Error(err.Error())
+	// 关闭后不再升级
+	if r.Hub.Closing() {
+		http.Error(rw, "Service Unavailable", 503)
 		return
 	}
 
-	// init uid
+	// init uid: token或cookie, 须在升级前
 	if se, err = session.HttpSessionUid(rw, req); err != nil {
 		http.Error(rw, err.Error(), 405)
 		return
@@ -158,17 +297,42 @@ func (r *Router) ServeWebSocket(rw http.ResponseWriter, req *http.Request) {
 		uid = se.Uid
 	}
 
-	// conn
-	c = &response.ConnWs{
-		Uid:      uid,
-		Send:     make(chan []byte, 256),
-		SendText: make(chan string),
-		Ws:       ws,
-		Hub:      r.Hub,
+	if ws, err = upgrader.Upgrade(rw, req, nil); err != nil {
+		log.Error(err.Error())
+		return
 	}
 
+	// conn
+	c = response.NewConnWs(&response.ConnWs{
+		Uid:     uid,
+		Session: se,
+		Ws:      ws,
+		Hub:     r.Hub,
+	})
+
 	// handler
-	c.Handler = func(req *response.Request) (res *response.Response) {
+	c.Handler = r.wsLogic()
+
+	//response.HubWsSet.Register <- c
+	if err = r.Hub.Register(c); err != nil {
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown"), time.Now().Add(response.WsWriteWait))
+		ws.Close()
+		return
+	}
+	go c.WritePump()
+	// 重连: 补发错过的推送
+	if s := req.URL.Query().Get(response.RequestTagSeq); len(s) > 0 {
+		if last, _err := strconv.ParseUint(s, 10, 64); _err == nil {
+			r.Hub.Resume(c, last)
+		}
+	}
+	c.ReadPump()
+}
+
+// 按虚拟路由处理请求, websocket与长轮询共用
+func (r *Router) wsLogic() response.LogicHandler {
+	return func(req *response.Request) (res *response.Response) {
 		// TODO: 将实际URL转为定义URL
 		log.Debug("ws recive url: ", req.Url)
 
@@ -183,11 +347,6 @@ func (r *Router) ServeWebSocket(rw http.ResponseWriter, req *http.Request) {
 		}
 		return
 	}
-
-	//response.HubWsSet.Register <- c
-	r.Hub.Register <- c
-	go c.WritePump()
-	c.ReadPump()
 }
 
 func (r *WsRouter) Handle(path string, handler response.LogicHandler) {
@@ -205,7 +364,9 @@ func (r *WsRouter) Handle(path string, handler response.LogicHandler) {
 // rewrite: Router
 func (r *Router) Handle(path string, handler response.RestHandler) (rt *Route) {
 	rt = new(Route)
-	rt.Route = r.Router.Handle(path, handler)
+	rt.router = r
+	rt.cors = &corsHandler{handler: handler, router: r}
+	rt.Route = r.Router.Handle(path, rt.cors)
 	//println("hhhh", path, r.Router, handler)
 	//
 	rt.WsRoute = newWsRoute(nil)
@@ -223,6 +384,7 @@ func (r *Router) HandleFunc(path string,
 }
 func (r *Router) PathPrefix(tpl string) (rt *Route) {
 	rt = new(Route)
+	rt.router = r
 	rt.Route = r.Router.PathPrefix(tpl)
 	//
 	rt.WsRoute = newWsRoute(nil)
@@ -239,11 +401,28 @@ func (r *Route) Subrouter() (rt *Router) {
 	rt.Router = r.Route.Subrouter()
 	rt.WsRouter.Map = r.WsRoute.Map
 	rt.WsRouter.Prefix = r.WsRoute.Url
+	rt.Cors = r.policy
+	rt.parent = r.router
 	return
 }
 
+// 设置该路由的cors策略; 对PathPrefix则作用于其Subrouter
+func (r *Route) Cors(p *response.CorsPolicy) *Route {
+	r.policy = p
+	if r.cors != nil {
+		r.cors.policy = p
+	}
+	return r
+}
+
 func (r *Route) Methods(methods ...string) *Route {
-	r.Route = r.Route.Methods(methods...)
+	lis := methods
+	// 预检须在方法匹配前交给corsHandler, 否则mux直接返回405
+	if r.cors != nil && hasMethod(methods, response.RequestCrudOptions) == false {
+		r.cors.methods = methods
+		lis = append(append([]string{}, methods...), response.RequestCrudOptions)
+	}
+	r.Route = r.Route.Methods(lis...)
 	r.WsRoute.Map.Methods(r.Url, methods...)
 	return r
 }
@@ -257,6 +436,7 @@ func newWsRouter(src *WsRouter) (r *WsRouter) {
 		r.Map = newWsRouterMap()
 	}
 	r.Hub = response.NewHubWs(nil)
+	r.hooks = new(sync.Once)
 	return
 }
 func newWsRoute(src *WsRoute) (r *WsRoute) {
@@ -275,13 +455,34 @@ func newWsRouterMap() *wsRouterMap {
 	return &wm
 }
 
+// 新建路由, 不读取配置; 仍在使用默认秘钥时写警告日志, 生产环境用NewRouterConfig
 func NewRouter() (r *Router) {
+	if session.SessionKeyIsDefault() {
+		log.Warn("router: session key is the built-in default, use NewRouterConfig or session.SetSessionKey before serving")
+	}
 	r = new(Router)
 	r.Router = mux.NewRouter()
 	r.WsRouter = newWsRouter(nil)
 	return
 }
 
+// 关闭websocket: 不再升级新连接, 其余见HubWs.Shutdown
+// 与http.Server.Shutdown一同调用, 如:
+//
+//	srv.RegisterOnShutdown(func() { r.Shutdown(ctx) })
+func (r *Router) Shutdown(ctx context.Context) error {
+	return r.WsRouter.Hub.Shutdown(ctx)
+}
+
+// 按配置新建路由: 配置无效时返回错误, 如非开发模式使用默认秘钥
+func NewRouterConfig(c *response.Config) (r *Router, err error) {
+	if err = c.Apply(); err != nil {
+		return
+	}
+	r = NewRouter()
+	return
+}
+
 func Vars(r *http.Request) map[string]string {
 	return mux.Vars(r)
 }
@@ -0,0 +1,311 @@
+package mux
+
+import (
+	"github.com/suboat/go-response"
+	"github.com/suboat/go-response/session"
+
+	"github.com/gorilla/websocket"
+
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Shutdown(t *testing.T) {
+	var (
+		r       = NewRouter()
+		started = make(chan struct{})
+		release = make(chan struct{})
+		done    = make(chan error)
+		msg     []byte
+		err     error
+	)
+	r.Handle("/slow", response.NewSimpleRestHandler(func(req *response.Request) (res *response.Response) {
+		close(started)
+		<-release
+		res = response.NewResponse(req)
+		res.Data = "done"
+		return
+	})).Methods("GET")
+	if err = r.ListenAndServeWs("/ws", nil); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if err = ws.WriteJSON(map[string]interface{}{"Method": "GET", "Url": "/slow", "RequestId": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	go func() {
+		done <- r.Shutdown(ctx)
+	}()
+	for r.Hub.Closing() == false {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 不再升级新连接
+	if _, resp, _err := websocket.DefaultDialer.Dial(url, nil); _err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("upgrade after shutdown: ", _err)
+	}
+
+	// 处理中的请求先返回, 之后收到going away
+	close(release)
+	if _, msg, err = ws.ReadMessage(); err != nil || strings.Contains(string(msg), `"done"`) == false {
+		t.Fatal("in-flight response: ", string(msg), err)
+	}
+	if _, _, err = ws.ReadMessage(); websocket.IsCloseError(err, websocket.CloseGoingAway) == false {
+		t.Fatal("close frame: ", err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 限定方法的路由也能答复预检
+func Test_CorsPreflight(t *testing.T) {
+	var r = NewRouter()
+	r.Cors = &response.CorsPolicy{AllowOrigins: []string{"https://a.example.com"}}
+	r.Handle("/item", response.NewSimpleRestHandler(func(req *response.Request) (res *response.Response) {
+		res = response.NewResponse(req)
+		res.Data = req.Method
+		return
+	})).Methods("GET")
+
+	req := httptest.NewRequest("OPTIONS", "/item", nil)
+	req.Header.Set("Origin", "https://a.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+	if rw.Code != http.StatusNoContent || rw.Header().Get("Access-Control-Allow-Origin") != "https://a.example.com" {
+		t.Fatal("preflight: ", rw.Code, rw.Header())
+	}
+	// 非预检的OPTIONS仍不允许
+	rw = httptest.NewRecorder()
+	r.ServeHTTP(rw, httptest.NewRequest("OPTIONS", "/item", nil))
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Fatal("options: ", rw.Code)
+	}
+	rw = httptest.NewRecorder()
+	r.ServeHTTP(rw, httptest.NewRequest("GET", "/item", nil))
+	if rw.Code != http.StatusOK || strings.Contains(rw.Body.String(), `"GET"`) == false {
+		t.Fatal("get: ", rw.Code, rw.Body.String())
+	}
+}
+
+func Test_Sse(t *testing.T) {
+	var (
+		r   = NewRouter()
+		uid = "sse"
+		tok string
+		err error
+	)
+	if tok, err = session.NewToken(session.TokenKidUser, map[string]interface{}{session.TokenTagUid: uid, session.TokenTagLevel: "1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.ListenAndServeSse("/sse"); err != nil {
+		t.Fatal(err)
+	}
+	heartbeat := response.SseHeartbeat
+	response.SseHeartbeat = time.Millisecond * 50
+	defer func() { response.SseHeartbeat = heartbeat }()
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	open := func(last string) (resp *http.Response, rd *bufio.Reader) {
+		req, _ := http.NewRequest("GET", srv.URL+"/sse", nil)
+		req.Header.Set(session.TokenTagHead, tok)
+		if len(last) > 0 {
+			req.Header.Set("Last-Event-ID", last)
+		}
+		if resp, err = http.DefaultClient.Do(req); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatal("content type: ", resp.Header)
+		}
+		rd = bufio.NewReader(resp.Body)
+		for r.Hub.Online(uid) == false {
+			time.Sleep(time.Millisecond)
+		}
+		return
+	}
+	// 读一个事件, 跳过心跳
+	event := func(rd *bufio.Reader) (ev string) {
+		for {
+			line, _err := rd.ReadString('\n')
+			if _err != nil {
+				t.Fatal(_err)
+			}
+			if line == "\n" {
+				if len(ev) > 0 {
+					return
+				}
+				continue
+			}
+			if strings.HasPrefix(line, ":") {
+				continue
+			}
+			ev += line
+		}
+	}
+
+	resp, rd := open("")
+	r.Hub.BroadcastTo(&uid, []byte(`{"n":1}`))
+	if ev := event(rd); ev != "id: 1\nevent: message\ndata: {\"seq\":1,\"n\":1}\n" {
+		t.Fatal("event: ", ev)
+	}
+	// 主题
+	if err = r.Hub.Subscribe(r.Hub.Conns(uid)[0], "news"); err != nil {
+		t.Fatal(err)
+	}
+	r.Hub.Publish("news", []byte(`{"n":2}`))
+	if ev := event(rd); strings.HasPrefix(ev, "id: 2\n") == false {
+		t.Fatal("topic: ", ev)
+	}
+	// 心跳
+	if line, _ := rd.ReadString('\n'); line != ": ping\n" {
+		t.Fatal("heartbeat: ", line)
+	}
+	resp.Body.Close()
+	for r.Hub.Online(uid) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 断开期间的推送以Last-Event-ID续传
+	r.Hub.BroadcastTo(&uid, []byte(`{"n":3}`))
+	resp, rd = open("2")
+	defer resp.Body.Close()
+	if ev := event(rd); strings.Contains(ev, `{"seq":3,"n":3}`) == false {
+		t.Fatal("resume: ", ev)
+	}
+}
+
+func Test_Poll(t *testing.T) {
+	var (
+		r   = NewRouter()
+		uid = "poll"
+		tok string
+		err error
+	)
+	if tok, err = session.NewToken(session.TokenKidUser, map[string]interface{}{session.TokenTagUid: uid, session.TokenTagLevel: "1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	r.Handle("/item", response.NewSimpleRestHandler(func(req *response.Request) (res *response.Response) {
+		res = response.NewResponse(req)
+		res.Data = "item"
+		return
+	})).Methods("GET")
+	if err = r.ListenAndServePoll("/poll"); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	type result struct {
+		Success bool
+		Error   string
+		Data    *response.PollResult
+	}
+	pollAs := func(tok string, method string, query string, body string) (res *result) {
+		req, _ := http.NewRequest(method, srv.URL+"/poll?"+query, strings.NewReader(body))
+		if len(tok) > 0 {
+			req.Header.Set(session.TokenTagHead, tok)
+		}
+		resp, _err := http.DefaultClient.Do(req)
+		if _err != nil {
+			t.Fatal(_err)
+		}
+		defer resp.Body.Close()
+		res = new(result)
+		if _err = json.NewDecoder(resp.Body).Decode(res); _err != nil {
+			t.Fatal(_err)
+		}
+		return
+	}
+	poll := func(method string, query string, body string) (res *result) {
+		return pollAs(tok, method, query, body)
+	}
+
+	// 新连接
+	res := poll("GET", "wait=0", "")
+	if res.Success == false || len(res.Data.Cid) == 0 || r.Hub.Online(uid) == false {
+		t.Fatal("open: ", res.Error)
+	}
+	cid := res.Data.Cid
+
+	// 请求交给虚拟路由, 回复随本次轮询返回
+	res = poll("POST", "wait=0&cid="+cid, `[{"Method":"GET","Url":"/item","RequestId":"1"}]`)
+	if res.Success == false || len(res.Data.Messages) != 1 || strings.Contains(string(res.Data.Messages[0]), `"item"`) == false {
+		t.Fatal("request: ", res.Error, res.Data)
+	}
+
+	// 等待中的轮询收到推送
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		r.Hub.BroadcastTo(&uid, []byte(`{"n":1}`))
+	}()
+	res = poll("GET", "cid="+cid, "")
+	if res.Success == false || len(res.Data.Messages) == 0 || strings.Contains(string(res.Data.Messages[0]), `"n":1`) == false {
+		t.Fatal("push: ", res.Error, res.Data)
+	}
+
+	// 推送不挤占回复, 满批的请求不阻塞
+	for i := 0; i < 10; i++ {
+		r.Hub.BroadcastTo(&uid, []byte(`{"n":2}`))
+	}
+	batch := make([]string, response.PollMaxBatch)
+	for i := range batch {
+		batch[i] = `{"Method":"GET","Url":"/item"}`
+	}
+	body := "[" + strings.Join(batch, ",") + "]"
+	for i := 0; i < 2; i++ {
+		if res = poll("POST", "wait=0&cid="+cid, body); res.Success == false || len(res.Data.Messages) != response.PollMaxBatch {
+			t.Fatal("batch: ", res.Error)
+		}
+	}
+	if res = poll("GET", "wait=0&cid="+cid, ""); res.Success == false || len(res.Data.Messages) != 10 {
+		t.Fatal("pushes after batch: ", res.Error)
+	}
+
+	// 未登录的请求不能使用他人的连接, 也不能打断等待中的轮询
+	wait := make(chan *result, 1)
+	go func() {
+		wait <- poll("GET", "cid="+cid, "")
+	}()
+	time.Sleep(time.Millisecond * 50)
+	if res = pollAs("", "GET", "wait=0&cid="+cid, ""); res.Success || res.Error != response.ErrSocketPollGone.Error() {
+		t.Fatal("anonymous: ", res.Error)
+	}
+	time.Sleep(time.Millisecond * 50)
+	r.Hub.BroadcastTo(&uid, []byte(`{"n":4}`))
+	if res = <-wait; res.Success == false || len(res.Data.Messages) == 0 || strings.Contains(string(res.Data.Messages[0]), `"n":4`) == false {
+		t.Fatal("anonymous wake: ", res.Error, res.Data)
+	}
+
+	// 未知的连接
+	if res = poll("GET", "wait=0&cid=none", ""); res.Success || res.Error != response.ErrSocketPollGone.Error() {
+		t.Fatal("unknown cid: ", res.Error)
+	}
+
+	// 关闭时不等待轮询连接
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err = r.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
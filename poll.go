@@ -0,0 +1,316 @@
+package response
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/suboat/go-response/log"
+	"github.com/suboat/go-response/session"
+
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 轮询参数: 连接id与等待秒数
+	RequestTagPollId   = "cid"
+	RequestTagPollWait = "wait"
+)
+
+var (
+	PollHold     = time.Second * 25 // 一次轮询最长等待, 须小于PollIdle
+	PollIdle     = time.Second * 60 // 多久没有轮询后注销连接
+	PollMaxBatch = 64               // 一次最多处理的请求数与返回的消息数
+)
+
+// 轮询结果
+type PollResult struct {
+	Cid      string            `json:"cid"`      // 连接id, 之后的轮询须带上
+	Messages []json.RawMessage `json:"messages"` // 推送与请求的回复, 按到达顺序
+}
+
+// 长轮询传输: 连接在轮询之间保留在hub中, 消息在队列中等待下次轮询取走
+type ConnPoll struct {
+	Id   string
+	conn *ConnWs
+	busy *sync.Mutex   // 同一时间只处理一个轮询
+	kick chan struct{} // 新的轮询到达或关闭时结束正在等待的轮询
+	kill chan struct{}
+	once sync.Once
+	last time.Time // 最近一次轮询, 由PollServer.lock保护
+}
+
+// 消息由轮询取走, 不直接写
+func (t *ConnPoll) WriteText(data []byte) error {
+	return ErrRequestSupport
+}
+
+// 注销连接, 之后该id的轮询返回ErrSocketPollGone
+func (t *ConnPoll) Close(code int, text string) {
+	t.once.Do(func() {
+		close(t.kill)
+	})
+}
+
+// 结束正在等待的轮询
+func (t *ConnPoll) wake() {
+	select {
+	case t.kick <- struct{}{}:
+	default:
+	}
+}
+
+// 长轮询入口: 与websocket共用hub, 请求交给handler, 如虚拟路由
+// GET或POST ?cid=...&wait=25, POST的body为请求数组, 格式同websocket消息
+type PollServer struct {
+	Hub     *HubWs
+	Handler LogicHandler
+
+	lock  *sync.Mutex
+	conns map[string]*ConnPoll
+}
+
+func (s *PollServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var (
+		res  = new(Response)
+		se   *session.Session
+		t    *ConnPoll
+		c    *ConnWs
+		lis  []json.RawMessage
+		cid  = req.URL.Query().Get(RequestTagPollId)
+		wait = PollHold
+	)
+	if req.Method != "GET" && req.Method != "POST" {
+		http.Error(rw, "Method not allowed", 405)
+		return
+	}
+	if s.Hub.Closing() {
+		http.Error(rw, "Service Unavailable", 503)
+		return
+	}
+	defer func() {
+		CreateResponse(rw, req, res)
+	}()
+
+	if se, res.Error = session.HttpSessionUid(rw, req); res.Error != nil {
+		return
+	}
+	// cookie会话提交请求须带csrf token
+	if req.Method == "POST" && se.Source == session.SessionSourceCookie {
+		if res.Error = session.CsrfCheck(req); res.Error != nil {
+			return
+		}
+	}
+	if v := req.URL.Query().Get(RequestTagPollWait); len(v) > 0 {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 && time.Duration(n)*time.Second < wait {
+			wait = time.Duration(n) * time.Second
+		}
+	}
+	if req.Method == "POST" && req.ContentLength != 0 {
+		b, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, WsMaxMessageSize*int64(PollMaxBatch)))
+		if err == nil {
+			err = json.Unmarshal(b, &lis)
+		}
+		if err != nil || len(lis) > PollMaxBatch {
+			res.Error = ErrRequestDataType
+			return
+		}
+	}
+
+	// 连接
+	if len(cid) == 0 {
+		if t, res.Error = s.open(se); res.Error != nil {
+			return
+		}
+	} else if t = s.get(cid); t == nil {
+		res.Error = ErrSocketPollGone
+		return
+	}
+	c = t.conn
+	// 会话须与连接的用户一致, 登录或退出后重新建立连接; 先检查, 别人的请求不能打断等待中的轮询
+	if se.Uid != c.GetUid() {
+		res.Error = ErrSocketPollGone
+		return
+	}
+	t.wake()
+	t.busy.Lock()
+	defer t.busy.Unlock()
+	defer s.touch(t)
+	if c.Closed() {
+		res.Error = ErrSocketPollGone
+		return
+	}
+	// 等待期间用户可能已改变
+	if se.Uid != c.GetUid() {
+		res.Error = ErrSocketPollGone
+		return
+	}
+
+	// 请求, 回复放入SendText; 每次轮询取走全部回复, 不超过剩余空间时发送回复不会阻塞
+	if len(lis) > cap(c.SendText)-len(c.SendText) {
+		res.Error = ErrRequestDataType
+		return
+	}
+	for _, msg := range lis {
+		if s.Hub.handlerBegin() == false {
+			break
+		}
+		c.serve(websocket.TextMessage, msg)
+	}
+
+	res.Data = &PollResult{Cid: t.Id, Messages: t.collect(req, wait)}
+	return
+}
+
+// 取消息: 已有时立即返回, 否则等待第一条或超时
+// 请求的回复全部取走, 推送最多取到PollMaxBatch条
+func (t *ConnPoll) collect(req *http.Request, wait time.Duration) (lis []json.RawMessage) {
+	var c = t.conn
+	lis = []json.RawMessage{}
+	take := func(b []byte) {
+		// 非json的推送以字符串返回
+		if json.Valid(b) == false {
+			b, _ = json.Marshal(string(b))
+		}
+		lis = append(lis, json.RawMessage(b))
+	}
+	more := func() {
+		for len(c.SendText) > 0 {
+			take([]byte(<-c.SendText))
+		}
+		for len(lis) < PollMaxBatch {
+			select {
+			case s := <-c.SendText:
+				take([]byte(s))
+			case b := <-c.Send:
+				c.flushOverflow()
+				take(b)
+			default:
+				if c.flushOverflow() == 0 {
+					return
+				}
+			}
+		}
+	}
+	// 清除之前的唤醒
+	select {
+	case <-t.kick:
+	default:
+	}
+	if more(); len(lis) > 0 || wait <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case s := <-c.SendText:
+		take([]byte(s))
+	case b := <-c.Send:
+		c.flushOverflow()
+		take(b)
+	case <-timer.C:
+	case <-t.kick:
+	case <-t.kill:
+	case <-c.closing:
+	case <-req.Context().Done():
+	}
+	more()
+	return
+}
+
+// 新建连接
+func (s *PollServer) open(se *session.Session) (t *ConnPoll, err error) {
+	t = &ConnPoll{
+		Id:   session.NewTokenId(),
+		busy: new(sync.Mutex),
+		kick: make(chan struct{}, 1),
+		kill: make(chan struct{}),
+		last: time.Now(),
+	}
+	t.conn = NewConnWs(&ConnWs{
+		Uid:       se.Uid,
+		Session:   se,
+		Hub:       s.Hub,
+		Handler:   s.Handler,
+		Transport: t,
+		SendText:  make(chan string, PollMaxBatch), // 同一轮询的回复在返回前不被取走
+	})
+	if err = s.Hub.Register(t.conn); err != nil {
+		return
+	}
+	s.lock.Lock()
+	s.conns[t.Id] = t
+	s.lock.Unlock()
+	go s.watch(t)
+	return
+}
+
+func (s *PollServer) get(cid string) *ConnPoll {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.conns[cid]
+}
+
+func (s *PollServer) touch(t *ConnPoll) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t.last = time.Now()
+}
+
+// 连接关闭时注销: 正在等待的轮询带着剩余消息返回
+func (s *PollServer) watch(t *ConnPoll) {
+	c := t.conn
+	select {
+	case <-c.closing:
+	case <-c.closed:
+	case <-t.kill:
+	}
+	t.wake()
+	t.busy.Lock()
+	s.lock.Lock()
+	delete(s.conns, t.Id)
+	s.lock.Unlock()
+	s.Hub.Unregister(c)
+	t.busy.Unlock()
+	close(c.done)
+}
+
+// 注销长时间没有轮询的连接, hub关闭后退出
+func (s *PollServer) reap() {
+	ticker := time.NewTicker(PollIdle / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			var idle []*ConnPoll
+			s.lock.Lock()
+			for _, t := range s.conns {
+				if now.Sub(t.last) > PollIdle {
+					idle = append(idle, t)
+				}
+			}
+			s.lock.Unlock()
+			for _, t := range idle {
+				log.Debug("poll idle: ", t.Id)
+				t.Close(websocket.CloseGoingAway, "idle")
+			}
+		case <-s.Hub.quit:
+			return
+		}
+	}
+}
+
+// new one
+func NewPollServer(h *HubWs, handler LogicHandler) (s *PollServer) {
+	s = &PollServer{
+		Hub:     h,
+		Handler: handler,
+		lock:    new(sync.Mutex),
+		conns:   make(map[string]*ConnPoll),
+	}
+	go s.reap()
+	return
+}
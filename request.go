@@ -28,7 +28,7 @@ const (
 var (
 	// allow CORS config
 	AllowCors     = true
-	AllowCorsHost = []string{}
+	AllowCorsHost = []string{} // 允许的来源, 规则见CorsPolicy.AllowOrigins; 为空则不允许跨域
 )
 
 // 格式化后的标准请求
@@ -51,8 +51,8 @@ type Request struct {
 	// For Post, Put, Delete
 	Data interface{}
 
-	Session  *session.Session // 会话信息,含用户uid及会话级别
-	RemoteIp string           // 请求ip,ban计数
+	Session  *session.Session `json:"-"` // 会话信息,含用户uid及会话级别; 只由服务端设置, 不从请求内容读取
+	RemoteIp string           `json:"-"` // 请求ip,ban计数
 }
 
 // 后台解析请求方法
@@ -63,20 +63,10 @@ func SerializeHttp(rw http.ResponseWriter, req *http.Request) (que *Request, err
 	)
 	que = new(Request)
 
-	//CORS
-	if AllowCors == true {
-		origin := req.Header.Get("Origin")
-
-		if len(origin) > 0 {
-			rw.Header().Add("Access-Control-Allow-Origin", origin)
-			rw.Header().Set("Access-Control-Allow-Credentials", "true")
-			rw.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization")
-		}
-
-		// options
-		if req.Method == "OPTIONS" {
-			//rw.Header().Add("Access-Control-Allow-Methods", "ACL, CANCELUPLOAD, CHECKIN, CHECKOUT, COPY, DELETE, GET, HEAD, LOCK, MKCALENDAR, MKCOL, MOVE, OPTIONS, POST, PROPFIND, PROPPATCH, PUT, REPORT, SEARCH, UNCHECKOUT, UNLOCK, UPDATE, VERSION-CONTROL")
-			rw.Header().Add("Access-Control-Allow-Methods", "DELETE, GET, HEAD, OPTIONS, POST, PUT, QUERY, UNLOCK, UPDATE")
+	//CORS: 路由已处理时跳过
+	if req.Context().Value(corsCtxKey{}) == nil {
+		if p := CorsDefault(); p != nil {
+			p.Apply(rw, req)
 		}
 	}
 
@@ -141,21 +131,20 @@ func SerializeHttp(rw http.ResponseWriter, req *http.Request) (que *Request, err
 	}
 	que.Url = req.URL.String()
 
+	// CSRF: cookie会话的非安全方法须带token, Authorization头不检查
+	if se != nil && se.Source == session.SessionSourceCookie &&
+		(session.CsrfUnsafe(req.Method) || session.CsrfUnsafe(que.Method)) {
+		err = session.CsrfCheck(req)
+	}
+
 	return
 }
 
 // 后台解析请求方法: ws
 func SerializeHttpWs(conn *ConnWs, msgType int, msg []byte) (que *Request, err error) {
-	var (
-		se *session.Session
-	)
-
 	// TODO: check msgType
 
-	// TODO: 解析session信息
 	que = new(Request)
-	que.Session.Uid = conn.Uid
-
 	if err = json.NewDecoder(bytes.NewReader(msg)).Decode(&que); err != nil {
 		return
 	}
@@ -166,9 +155,12 @@ func SerializeHttpWs(conn *ConnWs, msgType int, msg []byte) (que *Request, err e
 	if len(que.Token) > 0 {
 		if que.Session, err = session.TokenToUid(que.Token); err != nil {
 			return
-		} else {
-			que.Session = se
 		}
+		conn.SetSession(que.Session)
+	} else if conn.Session != nil {
+		// 沿用连接的会话, 如升级时的cookie
+		se := *conn.Session
+		que.Session = &se
 	} else {
 		// 匿名会话
 		que.Session = new(session.Session)
@@ -2,6 +2,7 @@ package response
 
 import (
 	"github.com/suboat/go-response/log"
+	"github.com/suboat/go-response/session"
 
 	"encoding/json"
 	"fmt"
@@ -32,7 +33,8 @@ type Response struct {
 	ErrorStr string `json:"error,omitempty"` // error格式无法输出, 需明确为字符串
 
 	// websocket
-	Uid string `json:"-"` // for ws: Logic handler 处理完后要改变当前会话uid, 为空则不改变
+	Uid     string           `json:"-"` // for ws: Logic handler 处理完后要改变当前会话uid, 为空则不改变
+	Session *session.Session `json:"-"` // for ws: 处理完后替换当前会话, 如提升会话级别, 为空则不改变
 }
 
 func (r *Response) ToJson() (s string) {
@@ -83,9 +85,9 @@ func CreateResponseWs(conn *ConnWs, d *Response) {
 		} else {
 			d.Success = true
 		}
-		conn.SendText <- d.ToJson()
+		conn.SendString(d.ToJson())
 	default:
-		conn.SendText <- d.ToJson()
+		conn.SendString(d.ToJson())
 	}
 
 	// TODO: 更详细的log
@@ -103,15 +105,3 @@ func NewResponse(req *Request) (res *Response) {
 	}
 	return
 }
-
-func init() {
-	//// debug
-	//go HubWsSet.run()
-
-	// ws CORS
-	if AllowCors && WsUpgrader.CheckOrigin == nil {
-		WsUpgrader.CheckOrigin = func(r *http.Request) bool {
-			return true
-		}
-	}
-}
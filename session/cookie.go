@@ -0,0 +1,119 @@
+package session
+
+import (
+	"github.com/suboat/go-response/log"
+
+	"github.com/gorilla/sessions"
+
+	"net/http"
+	"time"
+)
+
+const (
+	// 会话来源
+	SessionSourceToken  = "token"  // Authorization头
+	SessionSourceCookie = "cookie" // cookie
+)
+
+var (
+	SessionTagLevel = "level" // 会话级别
+	SessionTagIat   = "iat"   // 登录时间, 作废uid时一并失效
+)
+
+// cookie登录: 写入uid与会话级别, 并新建服务端会话
+func HttpSessionLogin(rw http.ResponseWriter, req *http.Request, uid string, level uint) (err error) {
+	var (
+		s *sessions.Session
+		e *SessionEntry
+	)
+	if len(uid) == 0 {
+		err = ErrTokenArgs
+		return
+	}
+	if e, err = NewSessionEntryHttp(req, uid); err != nil {
+		return
+	}
+	if s, err = SessionStore.Get(req, SessionStoreName); err != nil {
+		// 旧cookie无法解码时重新生成
+		log.Warn("session cookie: ", err)
+	}
+	s.Values[SessionTagSid] = e.Sid
+	s.Values[SessionTagUid] = uid
+	s.Values[SessionTagLevel] = level
+	s.Values[SessionTagIat] = unixMilli(time.Now())
+	s.Values[SessionAuthTag] = true
+	s.Values[SessionTagCsrf] = NewTokenId() // 登录后更换csrf token
+	err = s.Save(req, rw)
+	return
+}
+
+// cookie登出, 同时结束服务端会话
+func HttpSessionLogout(rw http.ResponseWriter, req *http.Request) (err error) {
+	var s *sessions.Session
+	if s, err = SessionStore.Get(req, SessionStoreName); err != nil {
+		log.Warn("session cookie: ", err)
+	}
+	if sid, _ := s.Values[SessionTagSid].(string); len(sid) > 0 {
+		if err = TerminateSession(sid); err != nil {
+			return
+		}
+	}
+	s.Values = make(map[interface{}]interface{})
+	s.Options.MaxAge = -1
+	err = s.Save(req, rw)
+	return
+}
+
+// 从cookie读Session, 未登录时se为nil
+func cookieSessionUid(req *http.Request) (se *Session, err error) {
+	var (
+		s     *sessions.Session
+		uid   string
+		sid   string
+		level uint
+		iat   float64
+		t     time.Time
+		u     *userBase
+	)
+	if _, _err := req.Cookie(SessionStoreName); _err != nil {
+		return
+	}
+	if s, err = SessionStore.Get(req, SessionStoreName); err != nil {
+		return
+	}
+	if auth, _ := s.Values[SessionAuthTag].(bool); auth == false {
+		return
+	}
+	if uid, _ = s.Values[SessionTagUid].(string); len(uid) == 0 {
+		return
+	}
+	// cookie不能携带一次性的支付级别
+	level, _ = s.Values[SessionTagLevel].(uint)
+	level &^= SessionLevelPay
+	iat, _ = s.Values[SessionTagIat].(float64)
+
+	// 服务端会话
+	if sid, _ = s.Values[SessionTagSid].(string); len(sid) > 0 {
+		if err = touchSession(sid, uid); err != nil {
+			return
+		}
+	}
+
+	// 作废uid后cookie同样失效
+	if t, err = TokenRevokeStore.UidRevokedAt(uid); err != nil {
+		return
+	} else if t.IsZero() == false && iat <= unixMilli(t) {
+		err = ErrTokenRevoked
+		return
+	}
+	// 用户状态
+	if u, err = PubUserGetByUid(uid); err != nil {
+		return
+	}
+	if err = checkUserStatus(u, level); err != nil {
+		return
+	}
+
+	se = &Session{Uid: uid, Secure: level, Source: SessionSourceCookie, Sid: sid}
+	return
+}
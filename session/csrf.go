@@ -0,0 +1,60 @@
+package session
+
+import (
+	"github.com/suboat/go-response/log"
+
+	"github.com/gorilla/sessions"
+
+	"crypto/subtle"
+	"net/http"
+)
+
+var (
+	CsrfHeader     = "X-Csrf-Token" // 客户端提交token的头
+	SessionTagCsrf = "csrf"         // cookie中保存的token
+)
+
+// 取当前cookie会话的csrf token, 没有时生成并写入cookie
+// token随签名的cookie保存, 客户端须经接口取得后放在CsrfHeader中提交
+func CsrfToken(rw http.ResponseWriter, req *http.Request) (token string, err error) {
+	var s *sessions.Session
+	if s, err = SessionStore.Get(req, SessionStoreName); err != nil {
+		// 旧cookie无法解码时重新生成
+		log.Warn("session cookie: ", err)
+	}
+	if token, _ = s.Values[SessionTagCsrf].(string); len(token) > 0 {
+		err = nil
+		return
+	}
+	token = NewTokenId()
+	s.Values[SessionTagCsrf] = token
+	err = s.Save(req, rw)
+	return
+}
+
+// 检查请求头中的csrf token与cookie中的是否一致
+func CsrfCheck(req *http.Request) (err error) {
+	var (
+		s     *sessions.Session
+		token string
+		head  = req.Header.Get(CsrfHeader)
+	)
+	if s, err = SessionStore.Get(req, SessionStoreName); err != nil {
+		return
+	}
+	token, _ = s.Values[SessionTagCsrf].(string)
+	if len(token) == 0 || len(head) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(head)) != 1 {
+		log.Warn("csrf rejected: ", req.RemoteAddr, " ", req.Method, " ", req.URL.Path)
+		err = ErrSessionCsrf
+	}
+	return
+}
+
+// 是否为需要检查csrf的方法
+func CsrfUnsafe(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+package session
+
+import (
+	"github.com/suboat/go-response/log"
+
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 密码验证: 由应用注册, 如校验支付密码
+type PasswordVerifier interface {
+	VerifyPassword(uid string, password string) error
+}
+
+// 以函数实现PasswordVerifier
+type PasswordVerifierFunc func(uid string, password string) error
+
+func (f PasswordVerifierFunc) VerifyPassword(uid string, password string) error {
+	return f(uid, password)
+}
+
+var (
+	TokenExpSecure     = time.Minute * 10 // 提升后的token有效期
+	ElevateMaxFailures = 5                // 连续失败多少次后锁定
+	ElevateLockout     = time.Minute * 15 // 锁定时长, 也是失败计数的窗口
+
+	passwordVerifier PasswordVerifier
+	elevateFailures  = make(map[string]*elevateFailure)
+	elevateLock      = new(sync.Mutex)
+)
+
+// 失败计数
+type elevateFailure struct {
+	count   int
+	pending int       // 验证中的尝试, 与失败一同计入上限
+	first   time.Time // 窗口开始
+	until   time.Time // 锁定到
+}
+
+// 注册密码验证
+func RegisterPasswordVerifier(v PasswordVerifier) {
+	elevateLock.Lock()
+	defer elevateLock.Unlock()
+	passwordVerifier = v
+}
+
+// 用密码提升会话级别, level为要增加的级别, 如SessionLevelSecure, SessionLevelPay
+// 连续失败ElevateMaxFailures次后锁定ElevateLockout
+func Elevate(se *Session, password string, level uint) (n *Session, err error) {
+	var (
+		v   PasswordVerifier
+		now = time.Now()
+	)
+	if se == nil || len(se.Uid) == 0 || se.Uid == GuestUid || se.Secure&SessionLevelNormal == 0 {
+		err = ErrSessionElevate
+		return
+	}
+	if len(password) == 0 {
+		err = ErrTokenArgs
+		return
+	}
+
+	elevateLock.Lock()
+	v = passwordVerifier
+	elevateLock.Unlock()
+	if v == nil {
+		err = ErrSessionElevate
+		return
+	}
+
+	// 先占用一次尝试, 并发的尝试也不超过上限
+	if err = elevateBegin(se.Uid, now); err != nil {
+		return
+	}
+	err = v.VerifyPassword(se.Uid, password)
+	if elevateEnd(se.Uid, now, err != nil); err != nil {
+		return
+	}
+	elevateReset(se.Uid)
+
+	n = new(Session)
+	*n = *se
+	n.Secure |= level
+
+	// 已冻结的用户不能进入安全会话
+	var u *userBase
+	if u, err = PubUserGetByUid(se.Uid); err != nil {
+		return
+	}
+	err = checkUserStatus(u, n.Secure)
+	return
+}
+
+// 占用一次尝试: 已锁定, 或失败数与验证中的尝试已达上限时返回ErrSessionLocked
+func elevateBegin(uid string, now time.Time) (err error) {
+	elevateLock.Lock()
+	defer elevateLock.Unlock()
+	for _uid, _f := range elevateFailures {
+		if _f.pending == 0 && now.Sub(_f.first) > ElevateLockout && now.After(_f.until) {
+			delete(elevateFailures, _uid)
+		}
+	}
+	f := elevateFailures[uid]
+	if f == nil {
+		f = &elevateFailure{first: now}
+		elevateFailures[uid] = f
+	} else if now.Sub(f.first) > ElevateLockout && now.After(f.until) {
+		// 新窗口
+		f.count = 0
+		f.first = now
+	}
+	if now.Before(f.until) || f.count+f.pending >= ElevateMaxFailures {
+		err = ErrSessionLocked
+		return
+	}
+	f.pending++
+	return
+}
+
+// 结束一次尝试, failed时计入失败
+func elevateEnd(uid string, now time.Time, failed bool) {
+	elevateLock.Lock()
+	defer elevateLock.Unlock()
+	f := elevateFailures[uid]
+	if f == nil {
+		return
+	}
+	f.pending--
+	if failed == false {
+		return
+	}
+	if f.count++; f.count >= ElevateMaxFailures {
+		f.until = now.Add(ElevateLockout)
+		log.Warn("elevate locked: ", uid)
+	}
+}
+
+// 成功后清除失败计数
+func elevateReset(uid string) {
+	elevateLock.Lock()
+	defer elevateLock.Unlock()
+	f := elevateFailures[uid]
+	if f == nil {
+		return
+	}
+	if f.pending > 0 {
+		f.count = 0
+		f.until = time.Time{}
+		return
+	}
+	delete(elevateFailures, uid)
+}
+
+// 为会话签发短期token, 保留原会话的类别与服务端会话
+// 签发后se.Jti更新为新token的id
+func NewSessionToken(se *Session, tExp *time.Duration) (token string, err error) {
+	var m = map[string]interface{}{
+		TokenTagUid:   se.Uid,
+		TokenTagLevel: strconv.Itoa(int(se.Secure)),
+		TokenTagUse:   TokenUseAccess,
+		TokenTagJti:   NewTokenId(),
+	}
+	exp := SessionTokenExp(se, tExp)
+	if len(se.Sid) > 0 {
+		m[TokenTagSid] = se.Sid
+	}
+	if token, err = NewToken(se.Role, m, &exp); err != nil {
+		return
+	}
+	se.Jti = m[TokenTagJti].(string)
+	if len(se.Sid) > 0 {
+		err = recordSessionTokens(se.Sid, map[string]time.Time{se.Jti: time.Now().Add(exp)})
+	}
+	return
+}
+
+// NewSessionToken签发的token的实际有效期, 含支付级别时不超过TokenExpPay
+func SessionTokenExp(se *Session, tExp *time.Duration) time.Duration {
+	return tokenExp(se.Secure, tExp, TokenExpSecure)
+}
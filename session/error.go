@@ -5,10 +5,32 @@ import (
 )
 
 var (
-	ErrTokenArgs         error = errors.New("token args error")
-	ErrTokenParseUnknow  error = errors.New("token parse unknown error")
-	ErrTokenParseInvalid error = errors.New("token parse invalid")
-	ErrSessionBan        error = errors.New("user was ban")
-	ErrSessionFrozen     error = errors.New("user was frozen")
-	ErrSessionReLogin    error = errors.New("user need relogin") // 用户需要重新登录一次
+	ErrTokenArgs           error = errors.New("token args error")
+	ErrTokenParseUnknow    error = errors.New("token parse unknown error")
+	ErrTokenParseInvalid   error = errors.New("token parse invalid")
+	ErrSessionBan          error = errors.New("user was ban")
+	ErrSessionFrozen       error = errors.New("user was frozen")
+	ErrSessionReLogin      error = errors.New("user need relogin") // 用户需要重新登录一次
+	ErrTokenKeyArgs        error = errors.New("token key args error")
+	ErrTokenKeyUnknown     error = errors.New("token key unknown")
+	ErrTokenKeyRetired     error = errors.New("token key was retired")
+	ErrTokenKeyAlg         error = errors.New("token key algorithm unsupport")
+	ErrTokenKeySign        error = errors.New("token key can not sign") // 只有公钥
+	ErrTokenKeyCurrent     error = errors.New("token key is current")   // 当前签名钥匙不能退役, 先轮换
+	ErrTokenUse            error = errors.New("token use error")        // 如用刷新token访问
+	ErrTokenRefreshReused  error = errors.New("refresh token reused")   // 刷新token被重放, 家族作废
+	ErrTokenRefreshRevoked error = errors.New("refresh token revoked")
+	ErrTokenRevoked        error = errors.New("token was revoked")
+	ErrSessionTerminated   error = errors.New("session was terminated") // 服务端会话已结束
+	ErrSessionPayRequired  error = errors.New("session pay level required")
+	ErrSessionPayUsed      error = errors.New("session pay grant was used") // 支付授权只能使用一次
+	ErrSessionElevate      error = errors.New("session can not elevate")
+	ErrSessionLocked       error = errors.New("session elevate locked") // 密码错误次数过多
+	ErrVerifyCodeInvalid   error = errors.New("verify code invalid")
+	ErrVerifyCodeFrequent  error = errors.New("verify code request too frequent")
+	ErrVerifyCodeSender    error = errors.New("verify code sender undefined")
+	ErrTotpInvalid         error = errors.New("totp code invalid")
+	ErrTotpReplay          error = errors.New("totp code was used") // 同一时间步的验证码只能用一次
+	ErrTotpUnbound         error = errors.New("totp unbound")
+	ErrSessionCsrf         error = errors.New("session csrf token invalid")
 )
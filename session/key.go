@@ -0,0 +1,244 @@
+package session
+
+import (
+	"github.com/dgrijalva/jwt-go"
+
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+const (
+	// 默认钥匙id: 由SessionKey派生, 兼容旧token
+	TokenKeyIdDefault = "default"
+)
+
+// 签名钥匙
+type Key struct {
+	Id        string            // kid
+	Method    jwt.SigningMethod // HS256, RS256, ES256
+	SignKey   interface{}       // 签名用: []byte, *rsa.PrivateKey, *ecdsa.PrivateKey; 为空则只能验证
+	VerifyKey interface{}       // 验证用: []byte, *rsa.PublicKey, *ecdsa.PublicKey
+	Retire    time.Time         // 退役时间, 之后不再验证; 零值表示不退役
+}
+
+// 钥匙集合: 按kid选择验证钥匙, 新token使用当前钥匙签名
+type KeySet struct {
+	lock    *sync.RWMutex
+	keys    map[string]*Key
+	current string // 当前签名钥匙id
+	Legacy  string // 未知kid时回退的钥匙id, 旧token的kid为user,admin; 为空则不回退
+}
+
+// 钥匙是否已退役
+func (k *Key) Retired(t time.Time) bool {
+	return k.Retire.IsZero() == false && t.After(k.Retire)
+}
+
+// 添加钥匙, 第一个添加的钥匙为当前签名钥匙
+func (ks *KeySet) Add(k *Key) (err error) {
+	if k == nil || len(k.Id) == 0 || k.Method == nil || k.VerifyKey == nil {
+		err = ErrTokenKeyArgs
+		return
+	}
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.keys[k.Id] = k
+	if len(ks.current) == 0 {
+		ks.current = k.Id
+	}
+	return
+}
+
+// 指定当前签名钥匙
+func (ks *KeySet) Use(kid string) (err error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	if k, ok := ks.keys[kid]; ok == false {
+		err = ErrTokenKeyUnknown
+		return
+	} else if k.SignKey == nil {
+		err = ErrTokenKeySign
+		return
+	} else if k.Retired(time.Now()) {
+		err = ErrTokenKeyRetired
+		return
+	}
+	ks.current = kid
+	return
+}
+
+// 轮换: 新钥匙成为当前签名钥匙, 旧钥匙在overlap后退役
+// 旧钥匙在退役前仍能验证已签发的token
+func (ks *KeySet) Rotate(k *Key, overlap time.Duration) (err error) {
+	if k == nil || k.SignKey == nil {
+		err = ErrTokenKeySign
+		return
+	}
+	if len(k.Id) == 0 || k.Method == nil || k.VerifyKey == nil {
+		err = ErrTokenKeyArgs
+		return
+	}
+	// 添加与切换在同一锁内, 其间不会取到半完成的状态
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.keys[k.Id] = k
+	if old, ok := ks.keys[ks.current]; ok && old.Id != k.Id {
+		old.Retire = time.Now().Add(overlap)
+	}
+	ks.current = k.Id
+	return
+}
+
+// 立即或定时退役某个钥匙, 当前签名钥匙须先轮换
+func (ks *KeySet) Retire(kid string, t time.Time) (err error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	if k, ok := ks.keys[kid]; ok == false {
+		err = ErrTokenKeyUnknown
+	} else if kid == ks.current && t.IsZero() == false {
+		err = ErrTokenKeyCurrent
+	} else {
+		k.Retire = t
+	}
+	return
+}
+
+// 清除已退役的钥匙
+func (ks *KeySet) Prune() {
+	now := time.Now()
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	for kid, k := range ks.keys {
+		if kid != ks.current && k.Retired(now) {
+			delete(ks.keys, kid)
+		}
+	}
+}
+
+// 当前签名钥匙
+func (ks *KeySet) Current() (k *Key, err error) {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	if k = ks.keys[ks.current]; k == nil {
+		err = ErrTokenKeyUnknown
+	} else if k.SignKey == nil {
+		err = ErrTokenKeySign
+	} else if k.Retired(time.Now()) {
+		// 不签发验证不了的token
+		err = ErrTokenKeyRetired
+	}
+	return
+}
+
+// 按kid取验证钥匙
+func (ks *KeySet) Lookup(kid string) (k *Key, err error) {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	var ok bool
+	if k, ok = ks.keys[kid]; ok == false && len(ks.Legacy) > 0 {
+		k, ok = ks.keys[ks.Legacy]
+	}
+	if ok == false {
+		err = ErrTokenKeyUnknown
+		return
+	}
+	if k.Retired(time.Now()) {
+		err = ErrTokenKeyRetired
+	}
+	return
+}
+
+// HS256 钥匙
+func NewKeyHmac(kid string, secret []byte) (k *Key) {
+	k = &Key{
+		Id:        kid,
+		Method:    jwt.SigningMethodHS256,
+		SignKey:   secret,
+		VerifyKey: secret,
+	}
+	return
+}
+
+// 从PEM文件读钥匙, alg支持RS256, ES256
+// privPath为空时只读公钥,只能用于验证; pubPath为空时从私钥导出公钥
+func LoadKeyPem(kid string, alg string, privPath string, pubPath string) (k *Key, err error) {
+	var (
+		privPem []byte
+		pubPem  []byte
+	)
+	if len(privPath) > 0 {
+		if privPem, err = ioutil.ReadFile(privPath); err != nil {
+			return
+		}
+	}
+	if len(pubPath) > 0 {
+		if pubPem, err = ioutil.ReadFile(pubPath); err != nil {
+			return
+		}
+	}
+	return NewKeyPem(kid, alg, privPem, pubPem)
+}
+
+// 从PEM内容生成钥匙
+func NewKeyPem(kid string, alg string, privPem []byte, pubPem []byte) (k *Key, err error) {
+	if len(privPem) == 0 && len(pubPem) == 0 {
+		err = ErrTokenKeyArgs
+		return
+	}
+	k = &Key{Id: kid}
+
+	switch alg {
+	case jwt.SigningMethodRS256.Alg():
+		k.Method = jwt.SigningMethodRS256
+		if len(privPem) > 0 {
+			priv, _err := jwt.ParseRSAPrivateKeyFromPEM(privPem)
+			if _err != nil {
+				err = _err
+				return
+			}
+			k.SignKey, k.VerifyKey = priv, &priv.PublicKey
+		}
+		if len(pubPem) > 0 {
+			if k.VerifyKey, err = jwt.ParseRSAPublicKeyFromPEM(pubPem); err != nil {
+				return
+			}
+		}
+		break
+	case jwt.SigningMethodES256.Alg():
+		k.Method = jwt.SigningMethodES256
+		if len(privPem) > 0 {
+			priv, _err := jwt.ParseECPrivateKeyFromPEM(privPem)
+			if _err != nil {
+				err = _err
+				return
+			}
+			k.SignKey, k.VerifyKey = priv, &priv.PublicKey
+		}
+		if len(pubPem) > 0 {
+			if k.VerifyKey, err = jwt.ParseECPublicKeyFromPEM(pubPem); err != nil {
+				return
+			}
+		}
+		break
+	default:
+		err = ErrTokenKeyAlg
+		return
+	}
+	return
+}
+
+// new one
+func NewKeySet(ks *KeySet) (n *KeySet) {
+	// placehold
+	if ks != nil {
+		n = ks
+		return
+	}
+
+	n = &KeySet{
+		lock: new(sync.RWMutex),
+		keys: make(map[string]*Key),
+	}
+	return
+}
@@ -0,0 +1,81 @@
+package session
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+func Test_KeySetRotate(t *testing.T) {
+	var (
+		ks      = NewKeySet(nil)
+		old     = TokenKeySet
+		tokOld  string
+		tokNew  string
+		rsaPriv *rsa.PrivateKey
+		ecPriv  *ecdsa.PrivateKey
+		k       *Key
+		err     error
+	)
+	TokenKeySet = ks
+	defer func() { TokenKeySet = old }()
+
+	// rs256 from pem
+	if rsaPriv, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if k, err = NewKeyPem("rsa-1", "RS256", pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaPriv),
+	}), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = ks.Add(k); err != nil {
+		t.Fatal(err)
+	}
+	if tokOld, err = NewToken(TokenKidUser, map[string]interface{}{TokenTagUid: "old"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// es256 rotate
+	if ecPriv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := x509.MarshalECPrivateKey(ecPriv)
+	if k, err = NewKeyPem("ec-1", "ES256", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = ks.Rotate(k, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if tokNew, err = NewToken(TokenKidUser, map[string]interface{}{TokenTagUid: "new"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 旧钥匙在退役前仍可验证
+	for _, s := range []string{tokOld, tokNew} {
+		if _, err = ParseTokenString(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 退役后失效
+	ks.Retire("rsa-1", time.Now().Add(-time.Second))
+	if _, err = ParseTokenString(tokOld); err == nil {
+		t.Fatal("retired key still verify")
+	}
+	if _, err = ParseTokenString(tokNew); err != nil {
+		t.Fatal(err)
+	}
+	// 当前签名钥匙不能退役, 也不能切换到已退役的钥匙
+	if err = ks.Retire("ec-1", time.Now()); err != ErrTokenKeyCurrent {
+		t.Fatal("retire current: ", err)
+	}
+	if err = ks.Use("rsa-1"); err != ErrTokenKeyRetired {
+		t.Fatal("use retired: ", err)
+	}
+}
@@ -0,0 +1,149 @@
+package session
+
+import (
+	"github.com/suboat/go-response/log"
+
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 支付授权状态
+	payGrantReserved = iota + 1 // 处理中
+	payGrantConsumed            // 已使用
+)
+
+var (
+	TokenExpPay = time.Minute * 5 // 含支付级别的token有效期上限
+
+	// 支付授权存储
+	TokenPayStore PayGrantStore = NewPayGrantStoreMemory(nil)
+
+	// 支付授权被重放时的回调, 用于审计
+	payReplayHooks     = []func(se *Session){}
+	payReplayHooksLock = new(sync.RWMutex)
+)
+
+// 支付授权存储: 以token的jti为授权id
+// Reserve须是原子的, 同一授权同时只有一个请求能占用
+type PayGrantStore interface {
+	Reserve(jti string, exp time.Time) error // 已占用或已使用返回ErrSessionPayUsed
+	Commit(jti string) error                 // 处理成功, 授权作废
+	Release(jti string) error                // 处理失败, 授权可再次使用
+}
+
+// 内存存储
+type PayGrantStoreMemory struct {
+	lock   *sync.Mutex
+	grants map[string]*payGrant
+}
+
+type payGrant struct {
+	status int
+	exp    time.Time
+}
+
+func (s *PayGrantStoreMemory) Reserve(jti string, exp time.Time) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.gc()
+	if _, ok := s.grants[jti]; ok {
+		err = ErrSessionPayUsed
+		return
+	}
+	s.grants[jti] = &payGrant{status: payGrantReserved, exp: exp}
+	return
+}
+
+func (s *PayGrantStoreMemory) Commit(jti string) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if g, ok := s.grants[jti]; ok {
+		g.status = payGrantConsumed
+	}
+	return
+}
+
+func (s *PayGrantStoreMemory) Release(jti string) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if g, ok := s.grants[jti]; ok && g.status == payGrantReserved {
+		delete(s.grants, jti)
+	}
+	return
+}
+
+// 清理过期记录, 需持有锁; 过期后token本身已失效
+func (s *PayGrantStoreMemory) gc() {
+	now := time.Now()
+	for jti, g := range s.grants {
+		if now.After(g.exp) {
+			delete(s.grants, jti)
+		}
+	}
+}
+
+// 占用会话的支付授权, 成功后须调用PayCommit或PayRelease
+func PayReserve(se *Session) (err error) {
+	if se == nil || se.Secure&SessionLevelPay == 0 || len(se.Jti) == 0 {
+		err = ErrSessionPayRequired
+		return
+	}
+	if err = TokenPayStore.Reserve(se.Jti, time.Now().Add(TokenExpPay)); err == ErrSessionPayUsed {
+		// 重放: 记录审计
+		log.Warn("pay grant replay: ", se.Uid, " ", se.Jti)
+		payReplayHooksLock.RLock()
+		for _, fn := range payReplayHooks {
+			fn(se)
+		}
+		payReplayHooksLock.RUnlock()
+	}
+	return
+}
+
+// 支付成功, 授权作废
+func PayCommit(se *Session) (err error) {
+	if err = TokenPayStore.Commit(se.Jti); err != nil {
+		return
+	}
+	se.Secure &^= SessionLevelPay
+	return
+}
+
+// 支付失败, 释放授权
+func PayRelease(se *Session) (err error) {
+	return TokenPayStore.Release(se.Jti)
+}
+
+// 注册支付授权重放的回调
+func OnPayReplay(fn func(se *Session)) {
+	payReplayHooksLock.Lock()
+	defer payReplayHooksLock.Unlock()
+	payReplayHooks = append(payReplayHooks, fn)
+}
+
+// 取claims中的会话级别
+func claimsLevel(m map[string]interface{}) (level uint) {
+	if v, ok := m[TokenTagLevel].(string); ok {
+		if i, err := strconv.Atoi(v); err == nil {
+			level = uint(i)
+		}
+	}
+	return
+}
+
+// new one
+func NewPayGrantStoreMemory(s *PayGrantStoreMemory) (n *PayGrantStoreMemory) {
+	// placehold
+	if s != nil {
+		n = s
+		return
+	}
+
+	n = &PayGrantStoreMemory{
+		lock:   new(sync.Mutex),
+		grants: make(map[string]*payGrant),
+	}
+	return
+}
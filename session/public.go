@@ -1,21 +1,81 @@
 package session
 
-//import (
-//	"github.com/suboat/sorm"
-//)
-
-//// 根据uid取出用户当前状态
-//// TODO:自己维护一个高速的方法
-//func PubUserGetByUid(uid orm.Uid) (u *userBase, err error) {
-//	if UserModel == nil {
-//		err = orm.ErrModelUndefined
-//		return
-//	}
-//
-//	u = new(userBase)
-//	if err = UserModel.Objects().Filter(orm.M{"uid": uid}).One(u); err != nil {
-//		// 查询失败或不唯一: 验证失败
-//		return
-//	}
-//	return
-//}
+import (
+	"sync"
+	"time"
+)
+
+// 用户状态提供者: 由应用注册, 如从数据库读用户状态
+type UserStatusProvider interface {
+	UserStatus(uid string) (status int, err error)
+}
+
+// 以函数实现UserStatusProvider
+type UserStatusProviderFunc func(uid string) (status int, err error)
+
+func (f UserStatusProviderFunc) UserStatus(uid string) (status int, err error) {
+	return f(uid)
+}
+
+var (
+	UserStatusCacheTtl = time.Second * 30 // 状态缓存时间, 0不缓存
+
+	userStatusProvider UserStatusProvider
+	userStatusCache    = make(map[string]*userStatusItem)
+	userStatusLock     = new(sync.RWMutex)
+)
+
+// 缓存项
+type userStatusItem struct {
+	userBase
+	exp time.Time
+}
+
+// 注册用户状态提供者, nil表示不检查用户状态
+func RegisterUserStatusProvider(p UserStatusProvider) {
+	userStatusLock.Lock()
+	defer userStatusLock.Unlock()
+	userStatusProvider = p
+	userStatusCache = make(map[string]*userStatusItem)
+}
+
+// 用户状态改变后清除缓存, 如禁用用户或修改密码后
+func UserStatusInvalidate(uid string) {
+	userStatusLock.Lock()
+	defer userStatusLock.Unlock()
+	delete(userStatusCache, uid)
+}
+
+// 根据uid取出用户当前状态, 未注册提供者时u为nil
+func PubUserGetByUid(uid string) (u *userBase, err error) {
+	var (
+		p      UserStatusProvider
+		item   *userStatusItem
+		status int
+		now    = time.Now()
+	)
+	userStatusLock.RLock()
+	p, item = userStatusProvider, userStatusCache[uid]
+	userStatusLock.RUnlock()
+
+	if p == nil {
+		return
+	}
+	if item != nil && now.Before(item.exp) {
+		u = &userBase{Uid: item.Uid, Status: item.Status}
+		return
+	}
+
+	if status, err = p.UserStatus(uid); err != nil {
+		// 查询失败: 验证失败
+		return
+	}
+	u = &userBase{Uid: uid, Status: status}
+
+	if UserStatusCacheTtl > 0 {
+		userStatusLock.Lock()
+		userStatusCache[uid] = &userStatusItem{userBase: *u, exp: now.Add(UserStatusCacheTtl)}
+		userStatusLock.Unlock()
+	}
+	return
+}
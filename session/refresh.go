@@ -0,0 +1,260 @@
+package session
+
+import (
+	"github.com/suboat/go-response/log"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// token用途
+	TokenUseAccess  = "access"  // 访问
+	TokenUseRefresh = "refresh" // 刷新
+)
+
+var (
+	TokenTagUse     = "use"               // token用途
+	TokenTagJti     = "jti"               // token id
+	TokenTagFamily  = "fid"               // 刷新token家族id, 同一次登录轮换出的token属于同一家族
+	TokenExpAccess  = time.Minute * 15    // 访问token有效期
+	TokenExpRefresh = time.Hour * 24 * 30 // 刷新token有效期
+
+	// 刷新token存储
+	TokenRefreshStore RefreshStore = NewRefreshStoreMemory(nil)
+)
+
+// 访问token与刷新token
+type TokenPair struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int64  `json:"expiresIn"` // 访问token有效秒数
+}
+
+// 刷新token记录
+type RefreshRecord struct {
+	Jti  string    // token id
+	Fid  string    // 家族id
+	Uid  string    // 所属用户
+	Used bool      // 已使用
+	Exp  time.Time // 过期时间
+}
+
+// 刷新token存储: Use须是原子的, 同一个jti只能成功使用一次
+type RefreshStore interface {
+	Save(r *RefreshRecord) error
+	Use(jti string) (r *RefreshRecord, err error) // 已使用返回ErrTokenRefreshReused, 家族已作废返回ErrTokenRefreshRevoked
+	RevokeFamily(fid string) error
+}
+
+// 内存存储
+type RefreshStoreMemory struct {
+	lock     *sync.Mutex
+	records  map[string]*RefreshRecord // jti
+	families map[string]time.Time      // 已作废的家族, 值为作废记录的过期时间
+}
+
+func (s *RefreshStoreMemory) Save(r *RefreshRecord) (err error) {
+	if r == nil || len(r.Jti) == 0 {
+		err = ErrTokenArgs
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.gc()
+	s.records[r.Jti] = r
+	return
+}
+
+func (s *RefreshStoreMemory) Use(jti string) (r *RefreshRecord, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var ok bool
+	if r, ok = s.records[jti]; ok == false {
+		err = ErrTokenRefreshRevoked
+		return
+	}
+	if _, ok = s.families[r.Fid]; ok {
+		err = ErrTokenRefreshRevoked
+		return
+	}
+	if r.Used {
+		err = ErrTokenRefreshReused
+		return
+	}
+	r.Used = true
+	return
+}
+
+func (s *RefreshStoreMemory) RevokeFamily(fid string) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.families[fid] = time.Now().Add(TokenExpRefresh)
+	for jti, r := range s.records {
+		if r.Fid == fid {
+			delete(s.records, jti)
+		}
+	}
+	return
+}
+
+// 清理过期记录, 需持有锁
+func (s *RefreshStoreMemory) gc() {
+	now := time.Now()
+	for jti, r := range s.records {
+		if now.After(r.Exp) {
+			delete(s.records, jti)
+		}
+	}
+	for fid, exp := range s.families {
+		if now.After(exp) {
+			delete(s.families, fid)
+		}
+	}
+}
+
+// 签发一对新token: 新登录时fid为空, 开始新的家族
+func NewTokenPair(role string, uid string, level uint, fid string) (p *TokenPair, err error) {
+	return newTokenPair(role, uid, level, fid, "")
+}
+
+// 签发一对新token, sid不为空时属于该服务端会话
+func newTokenPair(role string, uid string, level uint, fid string, sid string) (p *TokenPair, err error) {
+	var (
+		jtiAccess = NewTokenId()
+		jti       = NewTokenId()
+		exp       = TokenExpAccess
+		ref       = TokenExpRefresh
+		now       = time.Now()
+		access    = map[string]interface{}{
+			TokenTagUid:   uid,
+			TokenTagLevel: strconv.Itoa(int(level)),
+			TokenTagUse:   TokenUseAccess,
+			TokenTagJti:   jtiAccess,
+		}
+		refresh = map[string]interface{}{
+			TokenTagUid:    uid,
+			TokenTagLevel:  strconv.Itoa(int(level)),
+			TokenTagUse:    TokenUseRefresh,
+			TokenTagJti:    jti,
+			TokenTagFamily: fid,
+		}
+	)
+	if len(fid) == 0 {
+		refresh[TokenTagFamily] = NewTokenId()
+	}
+	if len(sid) > 0 {
+		access[TokenTagSid] = sid
+		refresh[TokenTagSid] = sid
+	}
+	p = &TokenPair{ExpiresIn: int64(exp / time.Second)}
+
+	if p.AccessToken, err = NewToken(role, access, &exp); err != nil {
+		return
+	}
+	if p.RefreshToken, err = NewToken(role, refresh, &ref); err != nil {
+		return
+	}
+	// 先记入会话, 会话已结束时刷新token不可用
+	if len(sid) > 0 {
+		if err = recordSessionTokens(sid, map[string]time.Time{
+			jtiAccess: now.Add(exp),
+			jti:       now.Add(ref),
+		}); err != nil {
+			return
+		}
+	}
+	err = TokenRefreshStore.Save(&RefreshRecord{
+		Jti: jti,
+		Fid: refresh[TokenTagFamily].(string),
+		Uid: uid,
+		Exp: now.Add(ref),
+	})
+	return
+}
+
+// 用刷新token换一对新token, 旧的刷新token同时失效
+// 已使用过的刷新token再次出现视为泄露, 整个家族作废
+func RefreshTokenPair(refreshStr string) (p *TokenPair, err error) {
+	var (
+		uid, role, jti, fid, sid, level string
+		ok                              bool
+		r                               *RefreshRecord
+		i                               int
+		token                           *jwt.Token
+	)
+	if token, err = ParseTokenString(refreshStr); err != nil {
+		return
+	}
+	if v, _ := token.Claims[TokenTagUse].(string); v != TokenUseRefresh {
+		err = ErrTokenUse
+		return
+	}
+	if uid, ok = token.Claims[TokenTagUid].(string); ok == false {
+		err = ErrTokenParseInvalid
+		return
+	}
+	role, _ = token.Claims[TokenTagRole].(string)
+	jti, _ = token.Claims[TokenTagJti].(string)
+	fid, _ = token.Claims[TokenTagFamily].(string)
+	sid, _ = token.Claims[TokenTagSid].(string)
+	level, _ = token.Claims[TokenTagLevel].(string)
+
+	// 已结束的会话不能刷新, 此时不占用刷新记录
+	if len(sid) > 0 {
+		if err = touchSession(sid, uid); err != nil {
+			return
+		}
+	}
+	if r, err = TokenRefreshStore.Use(jti); err != nil {
+		if err == ErrTokenRefreshReused {
+			// 重放: 作废整个家族
+			log.Warn("refresh token reused, revoke family: ", uid, " ", fid)
+			TokenRefreshStore.RevokeFamily(fid)
+		}
+		return
+	}
+	if r.Uid != uid || r.Fid != fid {
+		err = ErrTokenParseInvalid
+		return
+	}
+	if len(level) > 0 {
+		if i, err = strconv.Atoi(level); err != nil {
+			return
+		}
+	}
+
+	// 刷新得到的会话只保留普通级别
+	p, err = newTokenPair(role, uid, uint(i)&SessionLevelNormal, fid, sid)
+	return
+}
+
+// 随机token id
+func NewTokenId() (s string) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Panic("rand: ", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// new one
+func NewRefreshStoreMemory(s *RefreshStoreMemory) (n *RefreshStoreMemory) {
+	// placehold
+	if s != nil {
+		n = s
+		return
+	}
+
+	n = &RefreshStoreMemory{
+		lock:     new(sync.Mutex),
+		records:  make(map[string]*RefreshRecord),
+		families: make(map[string]time.Time),
+	}
+	return
+}
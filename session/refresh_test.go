@@ -0,0 +1,29 @@
+package session
+
+import (
+	"testing"
+)
+
+func Test_RefreshTokenPair(t *testing.T) {
+	var (
+		p1, p2 *TokenPair
+		err    error
+	)
+	if p1, err = NewTokenPair(TokenKidUser, "sometext", SessionLevelNormal, ""); err != nil {
+		t.Fatal(err)
+	}
+	// 刷新token不能用于访问
+	if _, err = TokenToUid(p1.RefreshToken); err != ErrTokenUse {
+		t.Fatal("refresh token used as access: ", err)
+	}
+	if p2, err = RefreshTokenPair(p1.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	// 重放旧token: 家族作废, 新token也失效
+	if _, err = RefreshTokenPair(p1.RefreshToken); err != ErrTokenRefreshReused {
+		t.Fatal("reuse not detected: ", err)
+	}
+	if _, err = RefreshTokenPair(p2.RefreshToken); err != ErrTokenRefreshRevoked {
+		t.Fatal("family not revoked: ", err)
+	}
+}
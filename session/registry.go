@@ -0,0 +1,372 @@
+package session
+
+import (
+	"github.com/suboat/go-response/log"
+
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	TokenTagSid                                = "sid"           // 服务端会话id
+	SessionTagSid                              = "sid"           // cookie中的会话id
+	SessionRegistryIdle                        = TokenExpRefresh // 会话闲置多久后清除
+	SessionRegistryTouch                       = time.Minute     // 最后活动时间的更新间隔, 避免每次请求都写存储
+	SessionRegistryTokens                      = 64              // 每个会话最多记录的token数
+	SessionRegistry       SessionRegistryStore = NewSessionRegistryMemory(nil)
+
+	// 会话结束后的回调, 如关闭该会话的websocket连接
+	terminateHooks     = []func(uid string, sid string){}
+	terminateHooksLock = new(sync.RWMutex)
+)
+
+// 服务端会话: 一次登录, 对应一台设备
+type SessionEntry struct {
+	Sid      string               `json:"sid"`
+	Uid      string               `json:"uid"`
+	Device   string               `json:"device"` // 如User-Agent
+	Ip       string               `json:"ip"`
+	Created  time.Time            `json:"created"`
+	LastSeen time.Time            `json:"lastSeen"`
+	Tokens   map[string]time.Time `json:"tokens"` // 该会话签发的token, jti: exp
+}
+
+// 会话存储
+type SessionRegistryStore interface {
+	Save(e *SessionEntry) error
+	Get(sid string) (e *SessionEntry, err error) // 不存在时e为nil
+	List(uid string) (lis []*SessionEntry, err error)
+	Delete(sid string) (e *SessionEntry, err error)                // 返回删除时的会话, 不存在时e为nil
+	Update(sid string, fn func(e *SessionEntry) error) (err error) // 原子修改, fn返回错误时不保存; 不存在时返回ErrSessionTerminated
+}
+
+// 内存存储
+type SessionRegistryMemory struct {
+	lock    *sync.RWMutex
+	Entries map[string]*SessionEntry `json:"entries"`
+}
+
+func (s *SessionRegistryMemory) Save(e *SessionEntry) (err error) {
+	if e == nil || len(e.Sid) == 0 {
+		err = ErrTokenArgs
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.gc()
+	s.Entries[e.Sid] = e.copy()
+	return
+}
+
+func (s *SessionRegistryMemory) Get(sid string) (e *SessionEntry, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if r, ok := s.Entries[sid]; ok {
+		e = r.copy()
+	}
+	return
+}
+
+func (s *SessionRegistryMemory) List(uid string) (lis []*SessionEntry, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	lis = []*SessionEntry{}
+	for _, r := range s.Entries {
+		if r.Uid == uid {
+			lis = append(lis, r.copy())
+		}
+	}
+	sort.Sort(sessionEntryLis(lis))
+	return
+}
+
+func (s *SessionRegistryMemory) Delete(sid string) (e *SessionEntry, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r, ok := s.Entries[sid]; ok {
+		e = r
+		delete(s.Entries, sid)
+	}
+	return
+}
+
+func (s *SessionRegistryMemory) Update(sid string, fn func(e *SessionEntry) error) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, ok := s.Entries[sid]
+	if ok == false {
+		err = ErrSessionTerminated
+		return
+	}
+	// 在拷贝上修改, fn出错时不影响存储
+	e := r.copy()
+	if err = fn(e); err != nil {
+		return
+	}
+	s.Entries[sid] = e
+	return
+}
+
+// 清理闲置会话, 需持有锁
+func (s *SessionRegistryMemory) gc() {
+	now := time.Now()
+	for sid, r := range s.Entries {
+		if now.Sub(r.LastSeen) > SessionRegistryIdle {
+			delete(s.Entries, sid)
+		}
+	}
+}
+
+// 文件存储: 每次修改后整体写入json文件
+type SessionRegistryFile struct {
+	*SessionRegistryMemory
+	Path string
+
+	saveLock *sync.Mutex
+}
+
+func (s *SessionRegistryFile) Save(e *SessionEntry) (err error) {
+	if err = s.SessionRegistryMemory.Save(e); err != nil {
+		return
+	}
+	return s.save()
+}
+
+func (s *SessionRegistryFile) Delete(sid string) (e *SessionEntry, err error) {
+	if e, err = s.SessionRegistryMemory.Delete(sid); err != nil || e == nil {
+		return
+	}
+	err = s.save()
+	return
+}
+
+func (s *SessionRegistryFile) Update(sid string, fn func(e *SessionEntry) error) (err error) {
+	if err = s.SessionRegistryMemory.Update(sid, fn); err != nil {
+		return
+	}
+	return s.save()
+}
+
+// 写入临时文件后改名, 避免写一半
+func (s *SessionRegistryFile) save() (err error) {
+	var b []byte
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	s.lock.RLock()
+	b, err = json.Marshal(s.SessionRegistryMemory)
+	s.lock.RUnlock()
+	if err != nil {
+		return
+	}
+	tmp := s.Path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+// 深拷贝, 存储内外互不影响
+func (e *SessionEntry) copy() (n *SessionEntry) {
+	n = new(SessionEntry)
+	*n = *e
+	n.Tokens = make(map[string]time.Time, len(e.Tokens))
+	for jti, exp := range e.Tokens {
+		n.Tokens[jti] = exp
+	}
+	return
+}
+
+// 记录该会话签发的token, 并去掉已过期的
+// 已满时去掉最早过期的: 会话结束后其token按sid失效, 见touchSession, 记录只用于立即作废
+func (e *SessionEntry) addToken(jti string, exp time.Time) {
+	now := time.Now()
+	if e.Tokens == nil {
+		e.Tokens = make(map[string]time.Time)
+	}
+	for _jti, _exp := range e.Tokens {
+		if now.After(_exp) {
+			delete(e.Tokens, _jti)
+		}
+	}
+	for len(e.Tokens) >= SessionRegistryTokens {
+		var (
+			first    string
+			firstExp time.Time
+		)
+		for _jti, _exp := range e.Tokens {
+			if len(first) == 0 || _exp.Before(firstExp) {
+				first, firstExp = _jti, _exp
+			}
+		}
+		log.Debug("session tokens full, drop: ", e.Sid, " ", first)
+		delete(e.Tokens, first)
+	}
+	e.Tokens[jti] = exp
+}
+
+// 记录会话签发的token, 会话不存在时返回ErrSessionTerminated
+func recordSessionTokens(sid string, tokens map[string]time.Time) (err error) {
+	return SessionRegistry.Update(sid, func(e *SessionEntry) error {
+		for jti, exp := range tokens {
+			e.addToken(jti, exp)
+		}
+		return nil
+	})
+}
+
+// 按创建时间排序
+type sessionEntryLis []*SessionEntry
+
+func (l sessionEntryLis) Len() int           { return len(l) }
+func (l sessionEntryLis) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l sessionEntryLis) Less(i, j int) bool { return l[i].Created.Before(l[j].Created) }
+
+// 新建服务端会话
+func NewSessionEntry(uid string, device string, ip string) (e *SessionEntry, err error) {
+	if len(uid) == 0 {
+		err = ErrTokenArgs
+		return
+	}
+	now := time.Now()
+	e = &SessionEntry{
+		Sid:      NewTokenId(),
+		Uid:      uid,
+		Device:   device,
+		Ip:       ip,
+		Created:  now,
+		LastSeen: now,
+		Tokens:   make(map[string]time.Time),
+	}
+	err = SessionRegistry.Save(e)
+	return
+}
+
+// 从http请求新建服务端会话, 设备取User-Agent
+func NewSessionEntryHttp(req *http.Request, uid string) (e *SessionEntry, err error) {
+	ip, _, _err := net.SplitHostPort(req.RemoteAddr)
+	if _err != nil {
+		ip = req.RemoteAddr
+	}
+	return NewSessionEntry(uid, req.UserAgent(), ip)
+}
+
+// 在会话中签发一对token, 刷新后的token仍属于该会话
+func (e *SessionEntry) NewTokenPair(role string, level uint) (p *TokenPair, err error) {
+	return newTokenPair(role, e.Uid, level, "", e.Sid)
+}
+
+// 列出用户的所有会话
+func ListSessions(uid string) (lis []*SessionEntry, err error) {
+	return SessionRegistry.List(uid)
+}
+
+// 结束一个会话: 作废其token, 并通知回调断开连接
+func TerminateSession(sid string) (err error) {
+	var e *SessionEntry
+	// 删除时取得会话, 之前记录的token都会作废, 之后的记录返回ErrSessionTerminated
+	if e, err = SessionRegistry.Delete(sid); err != nil || e == nil {
+		return
+	}
+	for jti, exp := range e.Tokens {
+		if err = TokenRevokeStore.Revoke(jti, exp); err != nil {
+			return
+		}
+	}
+	terminateHooksLock.RLock()
+	hooks := terminateHooks
+	terminateHooksLock.RUnlock()
+	for _, fn := range hooks {
+		fn(e.Uid, e.Sid)
+	}
+	return
+}
+
+// 结束用户的所有会话, 不在会话中签发的token也一并作废
+func TerminateSessionAll(uid string) (err error) {
+	var lis []*SessionEntry
+	if lis, err = SessionRegistry.List(uid); err != nil {
+		return
+	}
+	for _, e := range lis {
+		if err = TerminateSession(e.Sid); err != nil {
+			return
+		}
+	}
+	return RevokeUid(uid)
+}
+
+// 注册会话结束的回调
+func OnTerminateSession(fn func(uid string, sid string)) {
+	terminateHooksLock.Lock()
+	defer terminateHooksLock.Unlock()
+	terminateHooks = append(terminateHooks, fn)
+}
+
+// 检查会话是否仍有效, 并更新最后活动时间
+func touchSession(sid string, uid string) (err error) {
+	var e *SessionEntry
+	if e, err = SessionRegistry.Get(sid); err != nil {
+		return
+	}
+	if e == nil || e.Uid != uid {
+		err = ErrSessionTerminated
+		return
+	}
+	if now := time.Now(); now.Sub(e.LastSeen) > SessionRegistryTouch {
+		err = SessionRegistry.Update(sid, func(e *SessionEntry) error {
+			if e.Uid != uid {
+				return ErrSessionTerminated
+			}
+			if now.After(e.LastSeen) {
+				e.LastSeen = now
+			}
+			return nil
+		})
+	}
+	return
+}
+
+// new one
+func NewSessionRegistryMemory(s *SessionRegistryMemory) (n *SessionRegistryMemory) {
+	// placehold
+	if s != nil {
+		n = s
+		return
+	}
+
+	n = &SessionRegistryMemory{
+		lock:    new(sync.RWMutex),
+		Entries: make(map[string]*SessionEntry),
+	}
+	return
+}
+
+// 从文件读取, 文件不存在时新建
+func NewSessionRegistryFile(path string) (n *SessionRegistryFile, err error) {
+	var b []byte
+	n = &SessionRegistryFile{
+		SessionRegistryMemory: NewSessionRegistryMemory(nil),
+		Path:                  path,
+		saveLock:              new(sync.Mutex),
+	}
+	if b, err = ioutil.ReadFile(path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(b, n.SessionRegistryMemory); err != nil {
+		return
+	}
+	if n.Entries == nil {
+		n.Entries = make(map[string]*SessionEntry)
+	}
+	n.gc()
+	return
+}
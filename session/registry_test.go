@@ -0,0 +1,121 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_TerminateSession(t *testing.T) {
+	var (
+		e1, e2 *SessionEntry
+		p1, p2 *TokenPair
+		lis    []*SessionEntry
+		closed string
+		uid    = "device-" + NewTokenId() // 全局存储, 每次运行用不同的uid
+		err    error
+	)
+	OnTerminateSession(func(_uid string, sid string) {
+		if _uid == uid {
+			closed = sid
+		}
+	})
+	if e1, err = NewSessionEntry(uid, "phone", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if e2, err = NewSessionEntry(uid, "desktop", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if p1, err = e1.NewTokenPair(TokenKidUser, SessionLevelNormal); err != nil {
+		t.Fatal(err)
+	}
+	if p2, err = e2.NewTokenPair(TokenKidUser, SessionLevelNormal); err != nil {
+		t.Fatal(err)
+	}
+	if lis, err = ListSessions(uid); err != nil || len(lis) != 2 || lis[0].Device != "phone" {
+		t.Fatal("list: ", err, lis)
+	}
+
+	// 结束丢失的手机
+	if err = TerminateSession(e1.Sid); err != nil || closed != e1.Sid {
+		t.Fatal("terminate: ", err, closed)
+	}
+	if _, err = TokenToUid(p1.AccessToken); err != ErrTokenRevoked {
+		t.Fatal("access token alive: ", err)
+	}
+	if _, err = RefreshTokenPair(p1.RefreshToken); err != ErrTokenRevoked {
+		t.Fatal("refresh token alive: ", err)
+	}
+	if _, err = TokenToUid(p2.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+	if lis, _ = ListSessions(uid); len(lis) != 1 {
+		t.Fatal("list after terminate: ", lis)
+	}
+
+	// 刷新多次后记录已满, 结束会话时最新的token仍失效
+	for i := 0; i < SessionRegistryTokens; i++ {
+		if p2, err = RefreshTokenPair(p2.RefreshToken); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = TerminateSession(e2.Sid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = TokenToUid(p2.AccessToken); err == nil {
+		t.Fatal("newest access token alive")
+	}
+	if _, err = RefreshTokenPair(p2.RefreshToken); err == nil {
+		t.Fatal("newest refresh token alive")
+	}
+}
+
+func Test_SessionRegistryConcurrent(t *testing.T) {
+	var (
+		e   *SessionEntry
+		wg  sync.WaitGroup
+		err error
+	)
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := SessionRegistry
+	defer func() { SessionRegistry = store }()
+	if SessionRegistry, err = NewSessionRegistryFile(filepath.Join(dir, "sessions.json")); err != nil {
+		t.Fatal(err)
+	}
+	if e, err = NewSessionEntry("concurrent", "phone", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	// 并发记录的token都不丢失
+	exp := time.Now().Add(time.Hour)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _err := recordSessionTokens(e.Sid, map[string]time.Time{e.Sid + strconv.Itoa(i): exp}); _err != nil {
+				t.Error(_err)
+			}
+			touchSession(e.Sid, "concurrent")
+		}(i)
+	}
+	wg.Wait()
+	if e, err = SessionRegistry.Get(e.Sid); err != nil || len(e.Tokens) != 32 {
+		t.Fatal("tokens: ", err, e)
+	}
+	if err = TerminateSession(e.Sid); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := TokenRevokeStore.IsRevoked(e.Sid + "31"); ok == false {
+		t.Fatal("token not revoked")
+	}
+	if err = recordSessionTokens(e.Sid, map[string]time.Time{"late": exp}); err != ErrSessionTerminated {
+		t.Fatal("record after terminate: ", err)
+	}
+}
@@ -0,0 +1,247 @@
+package session
+
+import (
+	"github.com/dgrijalva/jwt-go"
+
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	TokenTagIat   = "iat"   // 签发时间, unix秒数, 见RFC 7519
+	TokenTagIatMs = "iatMs" // 签发时间, unix毫秒数, 作废uid时区分同一秒内签发的token
+
+	// 作废token存储
+	TokenRevokeStore RevokeStore = NewRevokeStoreMemory(nil)
+
+	// 作废uid全部token后的回调, 如关闭该用户的websocket连接
+	revokeUidHooks     = []func(uid string){}
+	revokeUidHooksLock = new(sync.RWMutex)
+)
+
+// 作废token存储
+type RevokeStore interface {
+	Revoke(jti string, exp time.Time) error           // 作废单个token, exp后可清除记录
+	IsRevoked(jti string) (bool, error)               //
+	RevokeUid(uid string, t time.Time) error          // 作废uid在t之前签发的所有token
+	UidRevokedAt(uid string) (t time.Time, err error) // 零值表示未作废
+}
+
+// 内存存储
+type RevokeStoreMemory struct {
+	lock *sync.RWMutex
+	Jti  map[string]time.Time `json:"jti"` // jti: exp
+	Uid  map[string]time.Time `json:"uid"` // uid: 作废时间
+}
+
+func (s *RevokeStoreMemory) Revoke(jti string, exp time.Time) (err error) {
+	if len(jti) == 0 {
+		err = ErrTokenArgs
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.gc()
+	s.Jti[jti] = exp
+	return
+}
+
+func (s *RevokeStoreMemory) IsRevoked(jti string) (ok bool, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	_, ok = s.Jti[jti]
+	return
+}
+
+func (s *RevokeStoreMemory) RevokeUid(uid string, t time.Time) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Uid[uid] = t
+	return
+}
+
+func (s *RevokeStoreMemory) UidRevokedAt(uid string) (t time.Time, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	t = s.Uid[uid]
+	return
+}
+
+// 清理过期记录, 需持有锁
+func (s *RevokeStoreMemory) gc() {
+	now := time.Now()
+	for jti, exp := range s.Jti {
+		if now.After(exp) {
+			delete(s.Jti, jti)
+		}
+	}
+}
+
+// 文件存储: 每次修改后整体写入json文件
+type RevokeStoreFile struct {
+	*RevokeStoreMemory
+	Path string
+
+	saveLock *sync.Mutex
+}
+
+func (s *RevokeStoreFile) Revoke(jti string, exp time.Time) (err error) {
+	if err = s.RevokeStoreMemory.Revoke(jti, exp); err != nil {
+		return
+	}
+	return s.save()
+}
+
+func (s *RevokeStoreFile) RevokeUid(uid string, t time.Time) (err error) {
+	if err = s.RevokeStoreMemory.RevokeUid(uid, t); err != nil {
+		return
+	}
+	return s.save()
+}
+
+// 写入临时文件后改名, 避免写一半
+func (s *RevokeStoreFile) save() (err error) {
+	var b []byte
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	s.lock.RLock()
+	b, err = json.Marshal(s.RevokeStoreMemory)
+	s.lock.RUnlock()
+	if err != nil {
+		return
+	}
+	tmp := s.Path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+// 作废一个token
+func RevokeToken(tokenStr string) (err error) {
+	var (
+		jti   string
+		exp   float64
+		token *jwt.Token
+	)
+	if token, err = ParseTokenString(tokenStr); err != nil {
+		return
+	}
+	if jti, _ = token.Claims[TokenTagJti].(string); len(jti) == 0 {
+		err = ErrTokenArgs
+		return
+	}
+	exp, _ = token.Claims[TokenTagExp].(float64)
+	return TokenRevokeStore.Revoke(jti, time.Unix(int64(exp), 0))
+}
+
+// 作废uid此前签发的所有token, 并通知回调
+func RevokeUid(uid string) (err error) {
+	if err = TokenRevokeStore.RevokeUid(uid, time.Now()); err != nil {
+		return
+	}
+	// 不持有锁调用, 回调中可以再作废
+	revokeUidHooksLock.RLock()
+	hooks := revokeUidHooks
+	revokeUidHooksLock.RUnlock()
+	for _, fn := range hooks {
+		fn(uid)
+	}
+	return
+}
+
+// 注册作废uid的回调
+func OnRevokeUid(fn func(uid string)) {
+	revokeUidHooksLock.Lock()
+	defer revokeUidHooksLock.Unlock()
+	revokeUidHooks = append(revokeUidHooks, fn)
+}
+
+// 检查token是否已作废
+func checkRevoked(claims map[string]interface{}) (err error) {
+	var (
+		ok  bool
+		t   time.Time
+		jti string
+		uid string
+		iat float64
+		ms  float64
+	)
+	if jti, _ = claims[TokenTagJti].(string); len(jti) > 0 {
+		if ok, err = TokenRevokeStore.IsRevoked(jti); err != nil {
+			return
+		} else if ok {
+			err = ErrTokenRevoked
+			return
+		}
+	}
+	if uid, _ = claims[TokenTagUid].(string); len(uid) > 0 {
+		if t, err = TokenRevokeStore.UidRevokedAt(uid); err != nil || t.IsZero() {
+			return
+		}
+		// 毫秒精度; 没有时按秒, 同一秒内签发的也作废
+		if ms, ok = claims[TokenTagIatMs].(float64); ok {
+			if int64(ms) <= t.UnixNano()/int64(time.Millisecond) {
+				err = ErrTokenRevoked
+			}
+			return
+		}
+		iat, _ = claims[TokenTagIat].(float64)
+		if int64(iat) <= t.Unix() {
+			err = ErrTokenRevoked
+			return
+		}
+	}
+	return
+}
+
+// 毫秒精度的unix秒数
+func unixMilli(t time.Time) float64 {
+	return float64(t.UnixNano()/int64(time.Millisecond)) / 1000
+}
+
+// new one
+func NewRevokeStoreMemory(s *RevokeStoreMemory) (n *RevokeStoreMemory) {
+	// placehold
+	if s != nil {
+		n = s
+		return
+	}
+
+	n = &RevokeStoreMemory{
+		lock: new(sync.RWMutex),
+		Jti:  make(map[string]time.Time),
+		Uid:  make(map[string]time.Time),
+	}
+	return
+}
+
+// 从文件读取, 文件不存在时新建
+func NewRevokeStoreFile(path string) (n *RevokeStoreFile, err error) {
+	var b []byte
+	n = &RevokeStoreFile{
+		RevokeStoreMemory: NewRevokeStoreMemory(nil),
+		Path:              path,
+		saveLock:          new(sync.Mutex),
+	}
+	if b, err = ioutil.ReadFile(path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(b, n.RevokeStoreMemory); err != nil {
+		return
+	}
+	if n.Jti == nil {
+		n.Jti = make(map[string]time.Time)
+	}
+	if n.Uid == nil {
+		n.Uid = make(map[string]time.Time)
+	}
+	n.gc()
+	return
+}
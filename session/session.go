@@ -7,12 +7,33 @@ import (
 	"github.com/gorilla/sessions"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 )
 
+const (
+	// 默认秘钥, 只能用于开发; 公开在源码中, 用它签名的token任何人都能伪造
+	// Config.Apply拒绝使用, 其它方式仍在使用时签发token会写警告日志
+	SessionKeyDefault = "jksijdnfhrwuxnfh"
+)
+
+var defaultKeyWarn sync.Once
+
+// 是否仍在使用默认秘钥
+func SessionKeyIsDefault() bool {
+	return SessionKey == SessionKeyDefault
+}
+
+// 用默认秘钥签名时警告一次
+func warnDefaultKey() {
+	defaultKeyWarn.Do(func() {
+		log.Warn("session: signing with the built-in default session key, anyone can forge tokens; set it with Config or SetSessionKey")
+	})
+}
+
 var (
 	// cookie
-	SessionKey       = "jksijdnfhrwuxnfh"                          // 秘钥
+	SessionKey       = SessionKeyDefault                           // 秘钥
 	SessionStore     = sessions.NewCookieStore([]byte(SessionKey)) // session cookie
 	SessionStoreName = "sessionid"                                 // session cookie的字段名称
 	SessionTagUid    = "uid"                                       // uid
@@ -21,19 +42,22 @@ var (
 	// jwt
 	TokenTagHead    = "Authorization"    // http head中存放token
 	TokenTagExp     = "exp"              //
-	TokenTagKid     = "kid"              //
+	TokenTagKid     = "kid"              // 签名钥匙id
 	TokenTagUid     = "uid"              //
 	TokenTagLevel   = "level"            // 会话等级
+	TokenTagRole    = "role"             // token类别: user, admin
 	TokenKidUser    = "user"             //
 	TokenKidAdmin   = "admin"            //
 	TokenExpDefault = time.Hour * 72     // token默认有效期
 	TokenSessionKey = []byte(SessionKey) // byte slice
+	TokenKeySet     = NewKeySet(nil)     // 签名钥匙集合
 )
 
 const (
 	SessionLevelNormal uint = 1 << iota // 用户授权
 	SessionLevelSecure                  // 安全密码已输入
 	SessionLevelPay                     // 支付级别,一次性使用
+	SessionLevelTotp                    // 两步验证已通过, 如管理员
 )
 
 const (
@@ -54,6 +78,10 @@ const (
 type Session struct {
 	Uid    string // uid
 	Secure uint   // 安全级别
+	Source string // 来源: token, cookie; 匿名为空
+	Sid    string // 服务端会话id, 可为空
+	Jti    string // token id, 支付授权以此为准
+	Role   string // token类别: TokenKidUser, TokenKidAdmin
 }
 
 // 含有uid字段与某些字段的model: 只为对应数据库映射，取uid
@@ -63,46 +91,30 @@ type userBase struct {
 	Status int    // 当前用户状态 正常,待激活,冻结,禁用
 }
 
-// 从http读Session
+// 从http读Session: 优先Authorization头中的token, 其次cookie
 func HttpSessionUid(rw http.ResponseWriter, req *http.Request) (se *Session, err error) {
-	se = new(Session)
-	// 默认uid
-	//uid = orm.GuestUid
-
-	//var (
-	//	ok   bool
-	//	v    interface{}
-	//	_uid orm.Uid
-	//	s    *sessions.Session
-	//)
-	//// 从cookie取Uid github.com/gorilla/sessions
-	//if s, err = SessionStore.Get(req, SessionStoreName); err != nil {
-	//	println(err.Error())
-	//	return
-	//}
-	////
-	//if v, ok = s.Values[SessionTagUid]; ok == true {
-	//	if _uid, ok = v.(orm.Uid); ok != true {
-	//		return
-	//	}
-	//	if err = _uid.Valid(); err != nil {
-	//		return
-	//	}
-	//	uid = _uid
-	//}
+	var _se *Session
 
 	// 从headToken中取uid
 	if tokenStr := req.Header.Get(TokenTagHead); len(tokenStr) > 0 {
-		if se, err = TokenToUid(tokenStr); err != nil {
+		if _se, err = TokenToUid(tokenStr); err != nil {
 			log.Warn("tokenStr error: ", err, " ", tokenStr)
 		}
+	} else if _se, err = cookieSessionUid(req); err != nil {
+		// 从cookie取Uid github.com/gorilla/sessions
+		log.Warn("session cookie error: ", err)
 	}
 
+	if _se != nil {
+		se = _se
+	} else {
+		se = new(Session)
+	}
 	return
 }
 
 // 解析token中的uid信息
-// TODO:验证token的时效性,如密码已更改,用户被禁用
+// 验证token的时效性,如密码已更改,用户被禁用
 func TokenToUid(tokenStr string) (se *Session, err error) {
 	se = new(Session)
 	var (
@@ -112,7 +124,7 @@ func TokenToUid(tokenStr string) (se *Session, err error) {
 		_uid   string
 		token  *jwt.Token
 		_uid_s string
-		//u      *userBase // 对应的用户
+		u      *userBase // 对应的用户
 	)
 
 	// 默认uid
@@ -121,6 +133,11 @@ func TokenToUid(tokenStr string) (se *Session, err error) {
 	if token, err = ParseTokenString(tokenStr); err != nil {
 		return
 	}
+	// 刷新token不能用于访问
+	if v, _ := token.Claims[TokenTagUse].(string); v == TokenUseRefresh {
+		err = ErrTokenUse
+		return
+	}
 
 	// 取uid
 	if v, ok = token.Claims[TokenTagUid]; ok == true {
@@ -146,50 +163,107 @@ func TokenToUid(tokenStr string) (se *Session, err error) {
 		}
 	}
 
-	//// 取用户验证
-	//if uid != orm.GuestUid {
-	//	if u, err = PubUserGetByUid(uid); err != nil {
-	//		return
-	//	}
-	//	// 已禁用的用户
-	//	if u.Status == UserStatusBand {
-	//		err = ErrSessionBan
-	//		return
-	//	}
-	//	// 需要重新登录
-	//	if u.Status == UserStatusReLogin {
-	//		err = ErrSessionReLogin
-	//		return
-	//	}
-	//	// 已冻结
-	//	if u.Status == UserStatusFreeze && (se.Secure&SessionLevelSecure > 0) {
-	//		err = ErrSessionFrozen
-	//		return
-	//	}
-	//}
+	se.Jti, _ = token.Claims[TokenTagJti].(string)
+	if se.Role, _ = token.Claims[TokenTagRole].(string); len(se.Role) == 0 {
+		// 旧token的类别在kid中
+		if kid, _ := token.Header[TokenTagKid].(string); kid == TokenKidUser || kid == TokenKidAdmin {
+			se.Role = kid
+		}
+	}
+
+	// 服务端会话: 已结束的会话不能再使用
+	if v, ok = token.Claims[TokenTagSid]; ok == true {
+		if se.Sid, _ = v.(string); len(se.Sid) > 0 {
+			if err = touchSession(se.Sid, uid); err != nil {
+				return
+			}
+		}
+	}
+
+	// 取用户验证: 须先注册UserStatusProvider
+	if uid != GuestUid {
+		if u, err = PubUserGetByUid(uid); err != nil {
+			return
+		}
+		if err = checkUserStatus(u, se.Secure); err != nil {
+			return
+		}
+	}
 
 	se.Uid = uid
+	se.Source = SessionSourceToken
+	return
+}
+
+// 按用户状态与会话级别检查, u为nil时不检查
+func checkUserStatus(u *userBase, level uint) (err error) {
+	if u == nil {
+		return
+	}
+	switch u.Status {
+	case UserStatusBand:
+		// 已禁用的用户
+		err = ErrSessionBan
+		break
+	case UserStatusReLogin:
+		// 需要重新登录
+		err = ErrSessionReLogin
+		break
+	case UserStatusFreeze:
+		// 已冻结: 不能进入安全会话
+		if level&(SessionLevelSecure|SessionLevelPay|SessionLevelTotp) > 0 {
+			err = ErrSessionFrozen
+		}
+		break
+	}
 	return
 }
 
-// map转tokenStr
-func NewToken(kid string, m map[string]interface{}, tExp *time.Duration) (token string, err error) {
+// token的实际有效期: tExp为空时用def, 支付级别只能短时间内使用
+func tokenExp(level uint, tExp *time.Duration, def time.Duration) time.Duration {
+	if tExp != nil {
+		def = *tExp
+	}
+	if level&SessionLevelPay > 0 && def > TokenExpPay {
+		def = TokenExpPay
+	}
+	return def
+}
+
+// map转tokenStr: 使用TokenKeySet的当前钥匙签名, role为token类别
+// 自动写入签发时间与jti, 以便作废
+func NewToken(role string, m map[string]interface{}, tExp *time.Duration) (token string, err error) {
+	var k *Key
 	if m == nil {
 		err = ErrTokenArgs
 		return
 	}
+	if k, err = TokenKeySet.Current(); err != nil {
+		return
+	}
 
-	// exp time
-	if tExp == nil {
-		tExp = &TokenExpDefault
+	if k.Id == TokenKeyIdDefault && SessionKeyIsDefault() {
+		warnDefaultKey()
 	}
 
-	t := jwt.New(jwt.SigningMethodHS256)
-	t.Header[TokenTagKid] = kid
+	// exp time
+	exp := tokenExp(claimsLevel(m), tExp, TokenExpDefault)
+
+	now := time.Now()
+	t := jwt.New(k.Method)
+	t.Header[TokenTagKid] = k.Id
 	t.Claims = m
-	t.Claims[TokenTagExp] = time.Now().Add(*tExp).Unix()
+	t.Claims[TokenTagExp] = now.Add(exp).Unix()
+	t.Claims[TokenTagIat] = now.Unix()
+	t.Claims[TokenTagIatMs] = now.UnixNano() / int64(time.Millisecond)
+	if _, ok := t.Claims[TokenTagJti]; ok == false {
+		t.Claims[TokenTagJti] = NewTokenId()
+	}
+	if len(role) > 0 {
+		t.Claims[TokenTagRole] = role
+	}
 
-	token, err = t.SignedString(TokenSessionKey)
+	token, err = t.SignedString(k.SignKey)
 	return
 }
 
@@ -199,6 +273,7 @@ func ParseTokenString(tokenStr string) (token *jwt.Token, err error) {
 		return
 	} else if token == nil {
 		err = ErrTokenParseUnknow
+		return
 	}
 
 	if token.Valid == false {
@@ -206,27 +281,72 @@ func ParseTokenString(tokenStr string) (token *jwt.Token, err error) {
 		return
 	}
 
+	// 已作废
+	err = checkRevoked(token.Claims)
 	return
 }
 
-// 解密钥匙
+// 解密钥匙: 按kid从TokenKeySet中取, 算法须与钥匙一致
 func lookupKey(token *jwt.Token) (inf interface{}, err error) {
-	switch token.Header[TokenTagKid] {
-	case TokenKidUser:
-		inf = TokenSessionKey
-		break
-	case TokenKidAdmin:
-		inf = TokenSessionKey
-		break
-	default:
-		inf = TokenSessionKey
-		break
+	var (
+		k      *Key
+		kid, _ = token.Header[TokenTagKid].(string)
+	)
+	if k, err = TokenKeySet.Lookup(kid); err != nil {
+		return
+	}
+	if token.Method == nil || token.Method.Alg() != k.Method.Alg() {
+		err = ErrTokenKeyAlg
+		return
 	}
+	inf = k.VerifyKey
+	return
+}
+
+// 更换秘钥: cookie与默认钥匙一并更换
+func SetSessionKey(key string) (err error) {
+	if len(key) == 0 {
+		err = ErrTokenKeyArgs
+		return
+	}
+	SessionKey = key
+	TokenSessionKey = []byte(key)
+	SessionStore = sessions.NewCookieStore(TokenSessionKey)
+	Init()
 	return
 }
 
+// 一并更换秘钥与钥匙集, 不修改原钥匙集; ks须已含由key派生的默认钥匙
+func SetSessionKeySet(key string, ks *KeySet) (err error) {
+	if len(key) == 0 || ks == nil {
+		err = ErrTokenKeyArgs
+		return
+	}
+	store := sessions.NewCookieStore([]byte(key))
+	store.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(TokenExpDefault / time.Second),
+		HttpOnly: true,
+	}
+	SessionKey = key
+	TokenSessionKey = []byte(key)
+	SessionStore = store
+	TokenKeySet = ks
+	return
+}
+
+// 初始化默认钥匙: 由TokenSessionKey派生, 并作为旧token的回退钥匙
+// 修改SessionKey或TokenSessionKey后需重新调用
 func Init() {
-	// TODO: read key file
+	TokenKeySet.Add(NewKeyHmac(TokenKeyIdDefault, TokenSessionKey))
+	TokenKeySet.Legacy = TokenKeyIdDefault
+
+	// cookie只供http使用
+	SessionStore.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(TokenExpDefault / time.Second),
+		HttpOnly: true,
+	}
 }
 
 func init() {
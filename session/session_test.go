@@ -2,7 +2,11 @@ package session
 
 import (
 	"github.com/dgrijalva/jwt-go"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func Test_NewToken(t *testing.T) {
@@ -34,3 +38,235 @@ func Test_ParseTokenString(t *testing.T) {
 		println("value:", token.Claims[TokenTagUid].(string))
 	}
 }
+
+func Test_RevokeToken(t *testing.T) {
+	var (
+		tok1, tok2 string
+		closed     string
+		err        error
+	)
+	OnRevokeUid(func(uid string) {
+		if uid == "revoke" {
+			closed = uid
+			// 回调中可以再作废
+			RevokeUid("revoke-child")
+		}
+	})
+	if tok1, err = NewToken(TokenKidUser, map[string]interface{}{TokenTagUid: "revoke"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if tok2, err = NewToken(TokenKidUser, map[string]interface{}{TokenTagUid: "revoke"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = RevokeToken(tok1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseTokenString(tok1); err != ErrTokenRevoked {
+		t.Fatal("jti not revoked: ", err)
+	}
+	// iat为整数秒
+	if token, _err := ParseTokenString(tok2); _err != nil {
+		t.Fatal(_err)
+	} else if iat, _ := token.Claims[TokenTagIat].(float64); iat != float64(int64(iat)) || iat == 0 {
+		t.Fatal("iat: ", token.Claims[TokenTagIat])
+	}
+	if err = RevokeUid("revoke"); err != nil || closed != "revoke" {
+		t.Fatal("revoke uid: ", err, closed)
+	}
+	if _, err = ParseTokenString(tok2); err != ErrTokenRevoked {
+		t.Fatal("uid not revoked: ", err)
+	}
+}
+
+func Test_UserStatusProvider(t *testing.T) {
+	var (
+		status = map[string]int{"ban": UserStatusBand, "relogin": UserStatusReLogin, "freeze": UserStatusFreeze}
+		calls  int
+		tok    string
+		err    error
+	)
+	RegisterUserStatusProvider(UserStatusProviderFunc(func(uid string) (int, error) {
+		calls++
+		return status[uid], nil
+	}))
+	defer RegisterUserStatusProvider(nil)
+
+	for uid, e := range map[string]error{"ban": ErrSessionBan, "relogin": ErrSessionReLogin, "freeze": nil, "normal": nil} {
+		if tok, err = NewToken(TokenKidUser, map[string]interface{}{TokenTagUid: uid}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = TokenToUid(tok); err != e {
+			t.Fatal(uid, ": ", err)
+		}
+	}
+	// 冻结用户不能进入安全会话
+	if tok, err = NewToken(TokenKidUser, map[string]interface{}{TokenTagUid: "freeze", TokenTagLevel: "3"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = TokenToUid(tok); err != ErrSessionFrozen {
+		t.Fatal("freeze: ", err)
+	}
+	// 缓存
+	if calls != 4 {
+		t.Fatal("cache miss: ", calls)
+	}
+}
+
+func Test_HttpSessionLogin(t *testing.T) {
+	var (
+		rw  = httptest.NewRecorder()
+		req = httptest.NewRequest("POST", "/login", nil)
+		se  *Session
+		err error
+	)
+	if err = HttpSessionLogin(rw, req, "cookie", SessionLevelNormal); err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	if se, err = HttpSessionUid(httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+	if se.Uid != "cookie" || se.Secure != SessionLevelNormal || se.Source != SessionSourceCookie {
+		t.Fatal("cookie session: ", se)
+	}
+}
+
+func Test_PayReserve(t *testing.T) {
+	var (
+		tok      string
+		se       *Session
+		replayed bool
+		err      error
+	)
+	OnPayReplay(func(se *Session) { replayed = true })
+	if tok, err = NewToken(TokenKidUser, map[string]interface{}{TokenTagUid: "pay", TokenTagLevel: "7"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := ParseTokenString(tok); int64(token.Claims[TokenTagExp].(float64)) > time.Now().Add(TokenExpPay).Unix() {
+		t.Fatal("pay token lifetime not capped")
+	}
+	// 失败后可再次使用
+	if se, err = TokenToUid(tok); err != nil {
+		t.Fatal(err)
+	}
+	if err = PayReserve(se); err != nil {
+		t.Fatal(err)
+	}
+	if err = PayRelease(se); err != nil {
+		t.Fatal(err)
+	}
+	// 成功后作废
+	if se, err = TokenToUid(tok); err != nil {
+		t.Fatal(err)
+	}
+	if err = PayReserve(se); err != nil {
+		t.Fatal(err)
+	}
+	PayCommit(se)
+	if se, err = TokenToUid(tok); err != nil {
+		t.Fatal(err)
+	}
+	if err = PayReserve(se); err != ErrSessionPayUsed || replayed == false {
+		t.Fatal("pay replay: ", err, replayed)
+	}
+}
+
+func Test_Elevate(t *testing.T) {
+	var (
+		se  = &Session{Uid: "elevate-" + NewTokenId(), Secure: SessionLevelNormal} // 失败锁定是全局的, 每次运行用不同的uid
+		n   *Session
+		tok string
+		err error
+	)
+	RegisterPasswordVerifier(PasswordVerifierFunc(func(uid string, password string) error {
+		if password != "123456" {
+			return ErrTokenArgs
+		}
+		return nil
+	}))
+	defer RegisterPasswordVerifier(nil)
+
+	if n, err = Elevate(se, "123456", SessionLevelSecure); err != nil || n.Secure&SessionLevelSecure == 0 {
+		t.Fatal("elevate: ", err)
+	}
+	if tok, err = NewSessionToken(n, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = TokenToUid(tok); err != nil || n.Secure != SessionLevelNormal|SessionLevelSecure {
+		t.Fatal("elevated token: ", err, n)
+	}
+	// 锁定
+	for i := 0; i < ElevateMaxFailures; i++ {
+		Elevate(se, "bad", SessionLevelSecure)
+	}
+	if _, err = Elevate(se, "123456", SessionLevelSecure); err != ErrSessionLocked {
+		t.Fatal("lockout: ", err)
+	}
+}
+
+// 并发尝试不超过失败上限
+func Test_ElevateConcurrent(t *testing.T) {
+	var (
+		se    = &Session{Uid: "elevate-parallel-" + NewTokenId(), Secure: SessionLevelNormal}
+		calls int32
+		wg    sync.WaitGroup
+	)
+	RegisterPasswordVerifier(PasswordVerifierFunc(func(uid string, password string) error {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(time.Millisecond * 20)
+		return ErrTokenArgs
+	}))
+	defer RegisterPasswordVerifier(nil)
+	for i := 0; i < ElevateMaxFailures*4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Elevate(se, "bad", SessionLevelSecure)
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n > int32(ElevateMaxFailures) {
+		t.Fatal("attempts past lockout: ", n)
+	}
+	if _, err := Elevate(se, "bad", SessionLevelSecure); err != ErrSessionLocked {
+		t.Fatal("lockout: ", err)
+	}
+
+	// 支付级别的token有效期不超过TokenExpPay
+	if exp := SessionTokenExp(&Session{Secure: SessionLevelNormal | SessionLevelPay}, nil); exp != TokenExpPay {
+		t.Fatal("pay exp: ", exp)
+	}
+}
+
+func Test_VerifyCode(t *testing.T) {
+	var (
+		sender = NewVerifyCodeSenderLog(nil)
+		code   string
+		err    error
+	)
+	RegisterVerifyCodeSender(sender)
+	defer RegisterVerifyCodeSender(nil)
+
+	if err = IssueVerifyCode("verify", "pay"); err != nil {
+		t.Fatal(err)
+	}
+	if err = IssueVerifyCode("verify", "pay"); err != ErrVerifyCodeFrequent {
+		t.Fatal("resend: ", err)
+	}
+	if code = sender.Code("verify", "pay"); len(code) != VerifyCodeLength {
+		t.Fatal("code: ", code)
+	}
+	if err = CheckVerifyCode("verify", "reset", code); err != ErrVerifyCodeInvalid {
+		t.Fatal("purpose: ", err)
+	}
+	if err = CheckVerifyCode("verify", "pay", code); err != nil {
+		t.Fatal(err)
+	}
+	// 只能使用一次
+	if err = CheckVerifyCode("verify", "pay", code); err != ErrVerifyCodeInvalid {
+		t.Fatal("reuse: ", err)
+	}
+}
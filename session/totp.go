@@ -0,0 +1,181 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// totp密钥提供者: 由应用注册, 绑定后由应用保存密钥
+type TotpSecretProvider interface {
+	TotpSecret(uid string) (secret string, err error) // 未绑定时secret为空
+}
+
+// 以函数实现TotpSecretProvider
+type TotpSecretProviderFunc func(uid string) (secret string, err error)
+
+func (f TotpSecretProviderFunc) TotpSecret(uid string) (secret string, err error) {
+	return f(uid)
+}
+
+var (
+	TotpPeriod = 30 // 时间步长, 秒
+	TotpDigits = 6  // 位数
+	TotpSkew   = 1  // 允许前后偏差的步数
+
+	totpSecretProvider TotpSecretProvider
+	totpUsed           = make(map[string]int64) // uid: 最近使用的时间步, 防重放
+	totpLock           = new(sync.Mutex)
+)
+
+// 注册totp密钥提供者
+func RegisterTotpSecretProvider(p TotpSecretProvider) {
+	totpLock.Lock()
+	defer totpLock.Unlock()
+	totpSecretProvider = p
+}
+
+// 生成密钥: base32, 无填充
+func NewTotpSecret() (secret string, err error) {
+	b := make([]byte, 20)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	secret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	return
+}
+
+// 绑定: 生成密钥与供验证器扫码的otpauth地址
+// 应用须在用户输入第一个验证码并通过TotpVerify后再保存密钥
+func TotpEnroll(issuer string, account string) (secret string, uri string, err error) {
+	if secret, err = NewTotpSecret(); err != nil {
+		return
+	}
+	uri = TotpUri(issuer, account, secret)
+	return
+}
+
+// otpauth地址
+func TotpUri(issuer string, account string, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(TotpDigits))
+	v.Set("period", fmt.Sprint(TotpPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + v.Encode()
+}
+
+// 计算某个时间的验证码, RFC 6238
+func TotpCode(secret string, t time.Time) (code string, err error) {
+	return totpCodeStep(secret, t.Unix()/int64(TotpPeriod))
+}
+
+func totpCodeStep(secret string, step int64) (code string, err error) {
+	var (
+		key []byte
+		msg = make([]byte, 8)
+		mod = uint32(1)
+	)
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	if key, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "=")); err != nil {
+		return
+	}
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	h := hmac.New(sha1.New, key)
+	h.Write(msg)
+	sum := h.Sum(nil)
+
+	// dynamic truncation, RFC 4226
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	for i := 0; i < TotpDigits; i++ {
+		mod *= 10
+	}
+	code = fmt.Sprintf("%0*d", TotpDigits, v%mod)
+	return
+}
+
+// 验证: 允许TotpSkew步的时钟偏差, 同一uid已使用过的时间步不能再用
+func TotpVerify(uid string, secret string, code string) (err error) {
+	var (
+		now = time.Now().Unix() / int64(TotpPeriod)
+		c   string
+	)
+	if len(secret) == 0 || len(code) != TotpDigits {
+		err = ErrTotpInvalid
+		return
+	}
+	totpLock.Lock()
+	defer totpLock.Unlock()
+	for step := now - int64(TotpSkew); step <= now+int64(TotpSkew); step++ {
+		if c, err = totpCodeStep(secret, step); err != nil {
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(c), []byte(code)) != 1 {
+			continue
+		}
+		if last, ok := totpUsed[uid]; ok && step <= last {
+			err = ErrTotpReplay
+			return
+		}
+		totpUsed[uid] = step
+		return
+	}
+	err = ErrTotpInvalid
+	return
+}
+
+// 用totp验证码提升会话级别为SessionLevelTotp, 与密码共用失败锁定
+func TotpElevate(se *Session, code string) (n *Session, err error) {
+	var (
+		p      TotpSecretProvider
+		secret string
+		u      *userBase
+		now    = time.Now()
+	)
+	if se == nil || len(se.Uid) == 0 || se.Uid == GuestUid || se.Secure&SessionLevelNormal == 0 {
+		err = ErrSessionElevate
+		return
+	}
+	totpLock.Lock()
+	p = totpSecretProvider
+	totpLock.Unlock()
+	if p == nil {
+		err = ErrSessionElevate
+		return
+	}
+	if secret, err = p.TotpSecret(se.Uid); err != nil {
+		return
+	} else if len(secret) == 0 {
+		err = ErrTotpUnbound
+		return
+	}
+	if err = elevateBegin(se.Uid, now); err != nil {
+		return
+	}
+	err = TotpVerify(se.Uid, secret, code)
+	if elevateEnd(se.Uid, now, err == ErrTotpInvalid); err != nil {
+		return
+	}
+	elevateReset(se.Uid)
+
+	if u, err = PubUserGetByUid(se.Uid); err != nil {
+		return
+	}
+	if err = checkUserStatus(u, se.Secure|SessionLevelTotp); err != nil {
+		return
+	}
+	n = new(Session)
+	*n = *se
+	n.Secure |= SessionLevelTotp
+	return
+}
@@ -0,0 +1,44 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_TotpCode(t *testing.T) {
+	// RFC 6238 附录B, SHA1, 8位
+	var secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // base32("12345678901234567890")
+	defer func(d int) { TotpDigits = d }(TotpDigits)
+	TotpDigits = 8
+	for ts, want := range map[int64]string{59: "94287082", 1111111109: "07081804", 2000000000: "69279037"} {
+		if code, err := TotpCode(secret, time.Unix(ts, 0)); err != nil || code != want {
+			t.Fatal(ts, ": ", code, err)
+		}
+	}
+}
+
+func Test_TotpElevate(t *testing.T) {
+	var (
+		se     = &Session{Uid: "totp-" + NewTokenId(), Secure: SessionLevelNormal, Role: TokenKidAdmin} // 已用的验证码是全局的, 每次运行用不同的uid
+		n      *Session
+		secret string
+		code   string
+		err    error
+	)
+	if secret, _, err = TotpEnroll("go-response", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	RegisterTotpSecretProvider(TotpSecretProviderFunc(func(uid string) (string, error) { return secret, nil }))
+	defer RegisterTotpSecretProvider(nil)
+
+	if code, err = TotpCode(secret, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = TotpElevate(se, code); err != nil || n.Secure&SessionLevelTotp == 0 {
+		t.Fatal("totp: ", err)
+	}
+	// 重放
+	if _, err = TotpElevate(se, code); err != ErrTotpReplay {
+		t.Fatal("replay: ", err)
+	}
+}
@@ -0,0 +1,216 @@
+package session
+
+import (
+	"github.com/suboat/go-response/log"
+
+	"crypto/rand"
+	"crypto/subtle"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// 验证码发送: 由应用注册, 如短信, 邮件
+type VerifyCodeSender interface {
+	SendVerifyCode(target string, purpose string, code string) error
+}
+
+// 只写日志的发送, 供开发与测试
+type VerifyCodeSenderLog struct {
+	lock *sync.Mutex
+	Last map[string]string // target+purpose: code
+}
+
+func (s *VerifyCodeSenderLog) SendVerifyCode(target string, purpose string, code string) (err error) {
+	log.Info("verify code: ", target, " ", purpose, " ", code)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Last[verifyCodeKey(target, purpose)] = code
+	return
+}
+
+// 最近一次发送的验证码
+func (s *VerifyCodeSenderLog) Code(target string, purpose string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.Last[verifyCodeKey(target, purpose)]
+}
+
+var (
+	VerifyCodeLength      = 6               // 位数
+	VerifyCodeTtl         = time.Minute * 5 // 有效期
+	VerifyCodeResend      = time.Minute     // 同一目标的重发间隔
+	VerifyCodeMaxAttempts = 5               // 最多尝试次数, 超过后作废
+
+	VerifyCodeStoreDefault VerifyCodeStore = NewVerifyCodeStoreMemory(nil)
+
+	verifyCodeSender     VerifyCodeSender // 未注册时不能发送
+	verifyCodeSenderLock = new(sync.RWMutex)
+)
+
+// 验证码记录
+type VerifyCodeRecord struct {
+	Target   string    // uid或手机号,邮箱
+	Purpose  string    // 用途, 如pay, reset
+	Code     string    //
+	Attempts int       // 已尝试次数
+	Created  time.Time //
+	Exp      time.Time //
+}
+
+// 验证码存储: Check须是原子的
+type VerifyCodeStore interface {
+	Save(r *VerifyCodeRecord) error                         // 重发间隔内返回ErrVerifyCodeFrequent
+	Check(target string, purpose string, code string) error // 成功或超过尝试次数后作废
+}
+
+// 内存存储
+type VerifyCodeStoreMemory struct {
+	lock    *sync.Mutex
+	records map[string]*VerifyCodeRecord
+}
+
+func (s *VerifyCodeStoreMemory) Save(r *VerifyCodeRecord) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.gc()
+	key := verifyCodeKey(r.Target, r.Purpose)
+	if old, ok := s.records[key]; ok && time.Since(old.Created) < VerifyCodeResend {
+		err = ErrVerifyCodeFrequent
+		return
+	}
+	s.records[key] = r
+	return
+}
+
+func (s *VerifyCodeStoreMemory) Check(target string, purpose string, code string) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := verifyCodeKey(target, purpose)
+	r, ok := s.records[key]
+	if ok == false || time.Now().After(r.Exp) {
+		delete(s.records, key)
+		err = ErrVerifyCodeInvalid
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Code), []byte(code)) == 1 {
+		// 只能使用一次
+		delete(s.records, key)
+		return
+	}
+	if r.Attempts++; r.Attempts >= VerifyCodeMaxAttempts {
+		delete(s.records, key)
+	}
+	err = ErrVerifyCodeInvalid
+	return
+}
+
+// 清理过期记录, 需持有锁
+func (s *VerifyCodeStoreMemory) gc() {
+	now := time.Now()
+	for key, r := range s.records {
+		if now.After(r.Exp) {
+			delete(s.records, key)
+		}
+	}
+}
+
+func verifyCodeKey(target string, purpose string) string {
+	return purpose + ":" + target
+}
+
+// 注册验证码发送
+func RegisterVerifyCodeSender(s VerifyCodeSender) {
+	verifyCodeSenderLock.Lock()
+	defer verifyCodeSenderLock.Unlock()
+	verifyCodeSender = s
+}
+
+// 生成并发送验证码
+func IssueVerifyCode(target string, purpose string) (err error) {
+	var (
+		code string
+		s    VerifyCodeSender
+		now  = time.Now()
+	)
+	if len(target) == 0 || len(purpose) == 0 {
+		err = ErrTokenArgs
+		return
+	}
+	verifyCodeSenderLock.RLock()
+	s = verifyCodeSender
+	verifyCodeSenderLock.RUnlock()
+	if s == nil {
+		err = ErrVerifyCodeSender
+		return
+	}
+	if code, err = newVerifyCode(VerifyCodeLength); err != nil {
+		return
+	}
+	if err = VerifyCodeStoreDefault.Save(&VerifyCodeRecord{
+		Target:  target,
+		Purpose: purpose,
+		Code:    code,
+		Created: now,
+		Exp:     now.Add(VerifyCodeTtl),
+	}); err != nil {
+		return
+	}
+	err = s.SendVerifyCode(target, purpose, code)
+	return
+}
+
+// 检查验证码
+func CheckVerifyCode(target string, purpose string, code string) (err error) {
+	if len(target) == 0 || len(code) == 0 {
+		err = ErrVerifyCodeInvalid
+		return
+	}
+	return VerifyCodeStoreDefault.Check(target, purpose, code)
+}
+
+// 随机数字
+func newVerifyCode(n int) (code string, err error) {
+	var (
+		b   = make([]byte, n)
+		i   *big.Int
+		ten = big.NewInt(10)
+	)
+	for j := range b {
+		if i, err = rand.Int(rand.Reader, ten); err != nil {
+			return
+		}
+		b[j] = byte('0' + i.Int64())
+	}
+	code = string(b)
+	return
+}
+
+// new one
+func NewVerifyCodeStoreMemory(s *VerifyCodeStoreMemory) (n *VerifyCodeStoreMemory) {
+	// placehold
+	if s != nil {
+		n = s
+		return
+	}
+
+	n = &VerifyCodeStoreMemory{
+		lock:    new(sync.Mutex),
+		records: make(map[string]*VerifyCodeRecord),
+	}
+	return
+}
+
+func NewVerifyCodeSenderLog(s *VerifyCodeSenderLog) (n *VerifyCodeSenderLog) {
+	// placehold
+	if s != nil {
+		n = s
+		return
+	}
+
+	n = &VerifyCodeSenderLog{
+		lock: new(sync.Mutex),
+		Last: make(map[string]string),
+	}
+	return
+}
@@ -3,14 +3,17 @@ package response
 import (
 	"github.com/gorilla/websocket"
 	"github.com/suboat/go-response/log"
+	"github.com/suboat/go-response/session"
 
 	//"net/http"
+	"context"
 	"encoding/json"
+	"hash/fnv"
 	"sync"
 	"time"
 )
 
-const (
+var (
 	// Time allowed to write a message to the peer.
 	WsWriteWait = 10 * time.Second
 
@@ -21,20 +24,24 @@ const (
 	WsPingPeriod = (WsPongWait * 9) / 10
 
 	// Maximum message size allowed from peer.
-	WsMaxMessageSize = 1024 * 2
+	WsMaxMessageSize int64 = 1024 * 2
+
+	// 连接表的分片数, NewHubWs时读取
+	HubWsShards = 16
 )
 
 // message push type
 const (
 	MessageWsTypePing   = iota // 0: nothing
-	MessageWsTypeLogin         // 1: login
-	MessageWsTypeLogout        // 2: logout
+	MessageWsTypeLogin         // 1: login, content为上线的uid
+	MessageWsTypeLogout        // 2: logout, content为下线的uid
 	MessageWsTypeStatus        // 3: update detail
 	MessageWsTypeMsg           // 4: have new message
+	MessageWsTypeResync        // 5: 错过的推送已不在缓冲中, 须重新同步, content为当前序号
 )
 
 var (
-	// upgrader
+	// upgrader; 设置CheckOrigin后mux路由不再使用cors策略检查来源, 只用它
 	WsUpgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
@@ -51,22 +58,71 @@ var (
 
 // hub maintains the set of active ConnWss and broadcasts messages to the
 // ConnWss.
+// 连接按uid分片保存, 每个分片一把锁; 发送队列不关闭, 以closed通知连接已注销
 type HubWs struct {
-	lock *sync.RWMutex
+	lock *sync.RWMutex // 保护closing, 事件与代理
 
-	// Registered ConnWss.
-	ConnWss map[string]map[*ConnWs]bool
-	//ConnWss map[orm.Uid][]*ConnWs
-	//ConnWss map[*ConnWs]bool
+	// 节点id, 用代理时区分各节点
+	Node string
 
-	// Inbound messages from the ConnWss.
-	Broadcast chan []byte
+	// Registered ConnWss.
+	shards []*hubShard
+
+	// 关闭
+	closing  bool           // 已开始关闭, 不再接受连接与请求
+	handlers sync.WaitGroup // 处理中的LogicHandler
+	quit     chan struct{}  // 已关闭
+
+	// 慢速连接, 为nil时用WsSlowPolicyDefault
+	SlowPolicy   *WsSlowPolicy
+	onSlow       []WsSlowHook
+	sent         uint64
+	dropped      uint64
+	disconnected uint64
+
+	// 主题
+	topicLock *sync.RWMutex
+	topics    map[string]map[*ConnWs]bool
+	topicAuth []WsTopicAuth
+
+	// 在线状态
+	presenceLock     *sync.Mutex
+	presence         map[string]*WsPresence
+	onPresence       []WsPresenceHook
+	presenceWatchers WsPresenceWatchers
+
+	// 跨节点代理
+	broker       Broker
+	brokerCancel func()
+
+	// 离线消息, 为nil时不保存; 须在使用前设置
+	OfflineStore OfflineStore
+	// 判断用户是否离线, 为nil时以本节点的连接为准; 用代理时须设置, 否则不保存
+	OfflineCheck func(uid string) bool
+
+	// 须确认的推送
+	ackLock      *sync.Mutex
+	acks         map[string]*AckMessage
+	ackOnce      sync.Once
+	onDeadLetter []WsDeadLetterHook
+
+	// 推送序号
+	seqLock *sync.Mutex
+	seqs    map[string]*seqBuffer
+	seqGc   time.Time // 上次清理缓冲的时间
+}
 
-	// Register requests from the ConnWss.
-	Register chan *ConnWs
+// 连接表分片
+type hubShard struct {
+	lock    *sync.RWMutex
+	conns   map[string]map[*ConnWs]bool
+	offline *sync.Mutex // 离线存储与上线的发送互斥, 见storeOffline
+}
 
-	// Unregister requests from ConnWss.
-	Unregister chan *ConnWs
+// 连接的传输方式: websocket以外, 如SSE, 长轮询
+type ConnTransport interface {
+	WriteText(data []byte) error // 写一条消息
+	Close(code int, text string) // 关闭, code为websocket的关闭码
 }
 
 // ConnWs is an middleman between the websocket ConnWs and the hub.
@@ -74,10 +130,18 @@ type ConnWs struct {
 	// The websocket ConnWs.
 	Ws *websocket.Conn
 
-	// uid
+	// 其它传输方式, 不为nil时不使用Ws
+	Transport ConnTransport
+
+	// uid, 只由读协程修改, 其它协程用GetUid
 	Uid string
 
+	// 会话: 升级时从token或cookie读取, 消息不带token时沿用
+	// 只由读协程修改, 其它协程用GetSession
+	Session *session.Session
+
 	// Buffered channel of outbound messages.
+	// 不会被关闭, 用SendBytes与SendString发送
 	Send     chan []byte
 	SendText chan string
 
@@ -86,6 +150,28 @@ type ConnWs struct {
 
 	// hub
 	Hub *HubWs
+
+	lock   *sync.RWMutex   // 保护Uid, Session与topics
+	topics map[string]bool // 订阅的主题: 是否为客户端订阅
+
+	// 慢速连接, 为nil时沿用hub的策略
+	SlowPolicy *WsSlowPolicy
+	qlock      *sync.Mutex // 保护overflow
+	overflow   [][]byte    // 溢出队列
+	sent       uint64
+	dropped    uint64
+	slowOnce   sync.Once
+
+	// 登记后第一次Resume前已发送的序号, 如离线消息, 续传时跳过; 由lock保护
+	seqSent    []uint64
+	seqResumed bool
+
+	// 关闭
+	closed     chan struct{} // 已注销, 发送方不再等待
+	closing    chan struct{} // 通知WritePump发送剩余消息后关闭
+	done       chan struct{} // WritePump已退出
+	closedOnce sync.Once
+	closeOnce  sync.Once
 }
 
 // MessageWs is a general type of push message by websocket
@@ -94,62 +180,348 @@ type MessageWs struct {
 	Content  string `json:"content"`
 }
 
-//
 type MessageWsPack struct {
-	TargetUid   *string      `json:"-"` // 推送到用户
-	TargetOther *string      `json:"-"` // 其它规则的推送
+	Id          string       `json:"id,omitempty"`  // 消息id, 须确认时客户端以ACK回复
+	Ack         bool         `json:"ack,omitempty"` // 是否须确认
+	Seq         uint64       `json:"seq,omitempty"` // 用户的推送序号, 发送时填写, 见HubWs.Resume
+	TargetUid   *string      `json:"-"`             // 推送到用户
+	TargetOther *string      `json:"-"`             // 其它规则的推送: 主题, 见HubWs.Publish
 	MessageLis  []*MessageWs `json:"messageLis"`
 }
 
-// change conn uid
+// change conn uid, 只在读协程中调用
 func (c *ConnWs) UidUpdate(uid string) (err error) {
 	if c.Hub == nil {
 		err = ErrSocketConnHubEmpty
 		return
 	}
-	if c.Uid != uid {
-		if err = c.Hub.EnsureUser(uid); err != nil {
-			return
-		}
-		c.Hub.ConnWss[uid][c] = true
-		log.Debug("old:", len(c.Hub.ConnWss[c.Uid]), " new:", len(c.Hub.ConnWss[uid]))
-		delete(c.Hub.ConnWss[c.Uid], c)
+	old := c.Uid
+	if old != uid {
+		c.lock.Lock()
 		c.Uid = uid
+		c.lock.Unlock()
+		c.Hub.move(c, old, uid)
+		c.Hub.reauthTopics(c)
+		log.Debug("conn uid: ", old, " -> ", uid)
+	}
+	if c.Session == nil || c.Session.Uid != uid {
+		se := &session.Session{Uid: uid}
+		if len(uid) > 0 && uid != session.GuestUid {
+			se.Secure = session.SessionLevelNormal
+		}
+		c.SetSession(se)
 	}
 	return
 }
 
+// 当前uid, 供其它协程读取
+func (c *ConnWs) GetUid() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.Uid
+}
+
+// 当前会话, 供其它协程读取
+func (c *ConnWs) GetSession() *session.Session {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.Session
+}
+
+// 替换会话, 只在读协程中调用
+func (c *ConnWs) SetSession(se *session.Session) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Session = se
+}
+
+// 推送消息, 不阻塞: 队列已满时按SlowPolicy处理, 已注销或丢弃时返回false
+func (c *ConnWs) SendBytes(data []byte) (ok bool) {
+	if c.Closed() {
+		return false
+	}
+	return c.enqueue(data)
+}
+
+// 回复请求, 等待WritePump接收; 已注销时返回false
+func (c *ConnWs) SendString(s string) (ok bool) {
+	select {
+	case c.SendText <- s:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+// 是否已注销
+func (c *ConnWs) Closed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// 补齐未设置的字段, 须在连接开始读写前调用
+func (c *ConnWs) init() {
+	if c.lock == nil {
+		c.lock = new(sync.RWMutex)
+		c.qlock = new(sync.Mutex)
+	}
+	if c.Send == nil {
+		c.Send = make(chan []byte, 256)
+	}
+	if c.SendText == nil {
+		c.SendText = make(chan string)
+	}
+	if c.closed == nil {
+		c.closed = make(chan struct{})
+		c.closing = make(chan struct{})
+		c.done = make(chan struct{})
+	}
+}
+
+// 分片
+func (h *HubWs) shard(uid string) *hubShard {
+	f := fnv.New32a()
+	f.Write([]byte(uid))
+	return h.shards[f.Sum32()%uint32(len(h.shards))]
+}
+
+// 每个分片的快照, 不持有锁调用fn
+func (h *HubWs) each(fn func(c *ConnWs)) {
+	for _, sh := range h.shards {
+		var conns []*ConnWs
+		sh.lock.RLock()
+		for _, uConns := range sh.conns {
+			for c, _ := range uConns {
+				conns = append(conns, c)
+			}
+		}
+		sh.lock.RUnlock()
+		for _, c := range conns {
+			fn(c)
+		}
+	}
+}
+
+// 加入分片
+func (h *HubWs) add(c *ConnWs, uid string) {
+	sh := h.shard(uid)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if _, ok := sh.conns[uid]; ok == false {
+		sh.conns[uid] = make(map[*ConnWs]bool)
+	}
+	sh.conns[uid][c] = true
+}
+
+// 移出分片
+func (h *HubWs) remove(c *ConnWs, uid string) {
+	sh := h.shard(uid)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if uConns, ok := sh.conns[uid]; ok {
+		delete(uConns, c)
+		if len(uConns) == 0 {
+			delete(sh.conns, uid)
+		}
+	}
+}
+
+// 改变连接的uid, 已注销的连接不再加入
+func (h *HubWs) move(c *ConnWs, old string, uid string) {
+	h.remove(c, old)
+	if c.Closed() == false {
+		h.addOnline(c, uid)
+		h.flushAck(c, uid)
+	}
+	h.presenceUpdate(old)
+	h.presenceUpdate(uid)
+}
+
 // make user map in hub
 func (h *HubWs) EnsureUser(uid string) (err error) {
-	// TODO: lock whith register
-	h.lock.Lock()
-	defer h.lock.Unlock()
-	if _, ok := h.ConnWss[uid]; ok == false {
-		h.ConnWss[uid] = make(map[*ConnWs]bool)
+	sh := h.shard(uid)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if _, ok := sh.conns[uid]; ok == false {
+		sh.conns[uid] = make(map[*ConnWs]bool)
 	}
 	return
 }
 
-// broadcasts to users
+// 用户的连接
+func (h *HubWs) Conns(uid string) (conns []*ConnWs) {
+	sh := h.shard(uid)
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+	for c, _ := range sh.conns[uid] {
+		conns = append(conns, c)
+	}
+	return
+}
+
+// 连接数
+func (h *HubWs) Len() (n int) {
+	for _, sh := range h.shards {
+		sh.lock.RLock()
+		for _, uConns := range sh.conns {
+			n += len(uConns)
+		}
+		sh.lock.RUnlock()
+	}
+	return
+}
+
+// 登记连接, 关闭后返回ErrSocketHubClosed
+func (h *HubWs) Register(c *ConnWs) (err error) {
+	// 加入连接表与发送离线消息之间不保存新的离线消息, 见storeOffline
+	sh := h.shard(c.Uid)
+	sh.offline.Lock()
+	h.lock.RLock()
+	if h.closing {
+		h.lock.RUnlock()
+		sh.offline.Unlock()
+		err = ErrSocketHubClosed
+		return
+	}
+	c.init()
+	c.Hub = h
+	h.add(c, c.Uid)
+	h.lock.RUnlock()
+	h.flushOffline(c, c.Uid)
+	sh.offline.Unlock()
+	log.Debug("newone: ", c.Uid)
+	h.flushAck(c, c.Uid)
+	h.presenceUpdate(c.Uid)
+	return
+}
+
+// 注销连接: 移出连接表并通知发送方与WritePump, 只在读协程中调用
+func (h *HubWs) Unregister(c *ConnWs) {
+	h.remove(c, c.Uid)
+	// 先标记注销, 之后的订阅被拒绝, 再退订
+	c.closedOnce.Do(func() {
+		close(c.closed)
+	})
+	h.unsubscribeAll(c)
+	h.presenceUpdate(c.Uid)
+}
+
+// broadcasts to users, uid为nil时发给所有连接; 有代理时同时发到其它节点
+// 不阻塞: 队列已满的连接按SlowPolicy处理
+// 用户离线时存入OfflineStore, 上线后发送
 func (h *HubWs) BroadcastTo(uid *string, data []byte) (err error) {
+	if uid != nil && h.storeOffline(*uid, data) {
+		return
+	}
+	h.broadcastOnline(uid, data)
+	return
+}
+
+// 只发给在线的连接, 包括其它节点, 不存离线消息
+func (h *HubWs) broadcastOnline(uid *string, data []byte) {
+	h.broadcastLocal(uid, data)
+	if uid == nil {
+		h.brokerPublish(BrokerKindAll, "", data)
+	} else {
+		h.brokerPublish(BrokerKindUid, *uid, data)
+	}
+}
+
+// 发给本节点的连接
+func (h *HubWs) broadcastLocal(uid *string, data []byte) {
 	if uid == nil {
 		// broadcasts to all
-		h.Broadcast <- data
+		var conns []*ConnWs
+		h.each(func(c *ConnWs) {
+			conns = append(conns, c)
+		})
+		h.deliverConns(conns, data)
 		return
 	}
+	h.deliver(*uid, h.Conns(*uid), data)
+}
+
+// 关闭用户的所有连接, 如token被作废
+func (h *HubWs) CloseUid(uid string) {
+	for _, c := range h.Conns(uid) {
+		c.Close(websocket.ClosePolicyViolation, "session revoked")
+	}
+}
+
+// 关闭某个服务端会话的连接
+func (h *HubWs) CloseSid(uid string, sid string) {
+	for _, c := range h.Conns(uid) {
+		if se := c.GetSession(); se != nil && se.Sid == sid {
+			c.Close(websocket.ClosePolicyViolation, "session terminated")
+		}
+	}
+}
+
+// 是否已开始关闭
+func (h *HubWs) Closing() bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.closing
+}
+
+// 开始处理一个请求, 关闭后返回false
+func (h *HubWs) handlerBegin() bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if h.closing {
+		return false
+	}
+	h.handlers.Add(1)
+	return true
+}
 
+// 关闭: 不再接受新连接与请求, 等待处理中的LogicHandler,
+// 再通知各连接发完已排队的消息后以CloseGoingAway关闭; ctx结束时直接断开剩余连接
+// hijack后的连接不受http.Server.Shutdown管理, 须一同调用
+func (h *HubWs) Shutdown(ctx context.Context) (err error) {
+	var (
+		conns []*ConnWs
+		wait  = make(chan struct{})
+	)
 	h.lock.Lock()
-	defer h.lock.Unlock()
-	for conn, _ := range h.ConnWss[*uid] {
+	if h.closing {
+		h.lock.Unlock()
+		return
+	}
+	h.closing = true
+	h.lock.Unlock()
+
+	// 处理中的请求
+	go func() {
+		h.handlers.Wait()
+		close(wait)
+	}()
+	select {
+	case <-wait:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// 通知连接关闭
+	h.each(func(c *ConnWs) {
+		conns = append(conns, c)
+		c.shutdown()
+	})
+	for _, c := range conns {
 		select {
-		case conn.Send <- data:
-			break
-		default:
-			go func() {
-				conn.Send <- data
-			}()
+		case <-c.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+			c.Close(websocket.CloseGoingAway, "server shutdown")
 		}
 	}
+	h.brokerStop()
+	close(h.quit)
+	log.Info("ws hub shutdown: ", len(conns), " conns")
 	return
 }
 
@@ -162,62 +534,15 @@ func (h *HubWs) BroadcastJson(uid *string, inf interface{}) (err error) {
 	return h.BroadcastTo(uid, data)
 }
 
-// Hub run
+// Hub run: 连接表已由分片锁保护, 只阻塞到Shutdown, 保留以兼容旧的调用
 func (h *HubWs) Run() {
-	// TODO: lock
-	for {
-		select {
-		case c := <-h.Register:
-			if err := h.EnsureUser(c.Uid); err != nil {
-				log.Error("hub EnsuerUser: ", err.Error())
-				return
-			}
-			if _, ok := h.ConnWss[c.Uid][c]; ok == true {
-				log.Error("unknown: ConnWs dunplicate", c)
-			}
-			h.ConnWss[c.Uid][c] = true
-			log.Debug("newone: ", c.Uid)
-		case c := <-h.Unregister:
-			c.Hub.lock.Lock()
-			delete(h.ConnWss[c.Uid], c)
-			close(c.Send)
-			close(c.SendText)
-			c.Hub.lock.Unlock()
-		case m := <-h.Broadcast:
-			// 广播给所有连接
-			h.lock.Lock()
-			for _, uConns := range h.ConnWss {
-				for c, _ := range uConns {
-					select {
-					case c.Send <- m:
-					default:
-						// 连接的send有数据, 跳过，不阻塞 TODO: 稍后再发
-						//close(c.Send)
-						//delete(h.ConnWss, uid)
-					}
-				}
-			}
-			h.lock.Unlock()
-
-			//for _, cLis := range h.ConnWss {
-			//	for _, c := range cLis {
-			//		select {
-			//		case c.Send <- m:
-			//		default:
-			//			close(c.Send)
-			//			//delete(h.ConnWss, uid)
-			//		}
-			//	}
-			//}
-		}
-	}
+	<-h.quit
 }
 
 // readPump pumps messages from the websocket ConnWs to the hub.
 func (c *ConnWs) ReadPump() {
 	defer func() {
-		//HubWsSet.Unregister <- c
-		c.Hub.Unregister <- c
+		c.Hub.Unregister(c)
 		c.Ws.Close()
 	}()
 
@@ -228,43 +553,115 @@ func (c *ConnWs) ReadPump() {
 	for {
 		msgType, message, err := c.Ws.ReadMessage()
 		if err != nil {
-			println("read ws error", err.Error())
+			log.Debug("read ws error: ", err.Error())
 			break
 		}
-		//println("recive text:", c.Uid, string(message))
-		que, err2 := SerializeHttpWs(c, msgType, message)
-		// serial error
-		if err2 != nil {
-			res := new(Response)
-			res.Error = err2
-			CreateResponseWs(c, res)
-			continue
+		// 关闭后不再处理新请求
+		if c.Hub.handlerBegin() == false {
+			break
 		}
-		if c.Handler == nil {
-			continue
+		c.serve(msgType, message)
+	}
+}
+
+// 处理一条请求
+func (c *ConnWs) serve(msgType int, message []byte) {
+	var err error
+	defer c.Hub.handlers.Done()
+
+	que, err2 := SerializeHttpWs(c, msgType, message)
+	// serial error
+	if err2 != nil {
+		res := new(Response)
+		res.Error = err2
+		CreateResponseWs(c, res)
+		return
+	}
+	// 订阅, 确认与重连协议
+	if res := c.serveTopic(que); res != nil {
+		CreateResponseWs(c, res)
+		return
+	}
+	if res := c.serveAck(que); res != nil {
+		CreateResponseWs(c, res)
+		return
+	}
+	if res := c.serveResume(que); res != nil {
+		CreateResponseWs(c, res)
+		return
+	}
+	if c.Handler == nil {
+		return
+	}
+	// handler
+	res := c.Handler(que)
+	// change uid
+	if len(res.Uid) > 0 {
+		err3 := c.UidUpdate(res.Uid)
+		if res.Error == nil {
+			res.Error = err3
 		}
-		// handler
-		res := c.Handler(que)
-		// change uid
-		if len(res.Uid) > 0 {
-			err3 := c.UidUpdate(res.Uid)
-			if res.Error == nil {
-				res.Error = err3
-			}
+	}
+	// change session
+	if res.Session != nil && res.Error == nil && res.Session.Uid == c.Uid {
+		c.SetSession(res.Session)
+	}
+	CreateResponseWs(c, res)
+
+	// message push
+	if res.MessageWsPack != nil {
+		if err = c.Hub.PushPack(res.MessageWsPack); err != nil {
+			log.Error("c.Hub.PushPack error: ", err)
 		}
-		CreateResponseWs(c, res)
+	}
+}
+
+// 通知WritePump关闭
+func (c *ConnWs) shutdown() {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+	})
+}
 
-		// message push
-		if res.MessageWsPack != nil {
-			if err = c.BroadcastJson(res.MessageWsPack.TargetUid, res.MessageWsPack); err != nil {
-				log.Error("c.BroadcastJson error: ", err)
+// 发送已排队的消息, 队列为空或出错时返回
+func (c *ConnWs) drain() {
+	for {
+		select {
+		case message := <-c.Send:
+			if c.writeText(message) != nil {
+				return
+			}
+		case message := <-c.SendText:
+			if c.writeText([]byte(message)) != nil {
+				return
+			}
+		default:
+			if c.flushOverflow() == 0 {
+				return
 			}
 		}
+	}
+}
+
+// 关闭连接, code为websocket的关闭码
+func (c *ConnWs) Close(code int, text string) {
+	if c.Transport != nil {
+		c.Transport.Close(code, text)
+		return
+	}
+	if c.Ws == nil {
+		return
+	}
+	c.Ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(WsWriteWait))
+	c.Ws.Close()
+}
 
-		//c.SendText <- string(message)
-		//hubSet.broadcast <- message
-		//c.Send <- message
+// 写一条文本消息
+func (c *ConnWs) writeText(data []byte) error {
+	if c.Transport != nil {
+		return c.Transport.WriteText(data)
 	}
+	return c.Write(websocket.TextMessage, data)
 }
 
 // write writes a message with the given message type and payload.
@@ -279,28 +676,29 @@ func (c *ConnWs) WritePump() {
 	defer func() {
 		ticker.Stop()
 		c.Ws.Close()
+		close(c.done)
 	}()
 	for {
 		select {
-		case message, ok := <-c.Send:
-			println("send bytea to", ok, c.Uid)
-			if !ok {
-				c.Write(websocket.CloseMessage, []byte{})
-				return
-			}
+		case message := <-c.Send:
+			c.flushOverflow()
 			if err := c.Write(websocket.TextMessage, message); err != nil {
 				return
 			}
-		case message, ok := <-c.SendText:
-			//println("send text to", ok, c.Uid.String(), message)
+		case message := <-c.SendText:
 			// text msg
-			if !ok {
-				c.Write(websocket.CloseMessage, []byte{})
-				return
-			}
 			if err := c.Write(websocket.TextMessage, []byte(message)); err != nil {
 				return
 			}
+		case <-c.closed:
+			c.Write(websocket.CloseMessage, []byte{})
+			return
+		case <-c.closing:
+			// 服务关闭: 发完剩余消息
+			c.drain()
+			c.Ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown"), time.Now().Add(WsWriteWait))
+			return
 		case <-ticker.C:
 			//println("ticker time, ping again", c.Uid.String())
 			if err := c.Write(websocket.PingMessage, []byte{}); err != nil {
@@ -313,35 +711,11 @@ func (c *ConnWs) WritePump() {
 // broadcasts to users
 func (c *ConnWs) Broadcast(uid *string, data []byte) (err error) {
 	return c.Hub.BroadcastTo(uid, data)
-	//if uid == nil {
-	//	// broadcasts to all
-	//	c.Hub.Broadcast <- data
-	//	return
-	//}
-
-	//c.Hub.lock.Lock()
-	//defer c.Hub.lock.Unlock()
-	//for conn, _ := range c.Hub.ConnWss[*uid] {
-	//	select {
-	//	case conn.Send <- data:
-	//		break
-	//	default:
-	//		go func() {
-	//			conn.Send <- data
-	//		}()
-	//	}
-	//}
-	return
 }
 
 // broadcasts json
 func (c *ConnWs) BroadcastJson(uid *string, inf interface{}) (err error) {
 	return c.Hub.BroadcastJson(uid, inf)
-	//var data = []byte{}
-	//if data, err = json.Marshal(inf); err != nil {
-	//	return
-	//}
-	//return c.Broadcast(uid, data)
 }
 
 func NewHubWs(h *HubWs) (n *HubWs) {
@@ -352,13 +726,41 @@ func NewHubWs(h *HubWs) (n *HubWs) {
 	}
 
 	n = &HubWs{
-		lock:       new(sync.RWMutex),
-		Broadcast:  make(chan []byte),
-		Register:   make(chan *ConnWs),
-		Unregister: make(chan *ConnWs),
-		ConnWss:    make(map[string]map[*ConnWs]bool),
-		//ConnWss: make(map[*ConnWs]bool),
+		lock:   new(sync.RWMutex),
+		Node:   session.NewTokenId(),
+		shards: make([]*hubShard, HubWsShards),
+		quit:   make(chan struct{}),
+
+		topicLock: new(sync.RWMutex),
+		topics:    make(map[string]map[*ConnWs]bool),
+
+		presenceLock: new(sync.Mutex),
+		presence:     make(map[string]*WsPresence),
+
+		ackLock: new(sync.Mutex),
+		acks:    make(map[string]*AckMessage),
+
+		seqLock: new(sync.Mutex),
+		seqs:    make(map[string]*seqBuffer),
+	}
+	for i := range n.shards {
+		n.shards[i] = &hubShard{
+			lock:    new(sync.RWMutex),
+			conns:   make(map[string]map[*ConnWs]bool),
+			offline: new(sync.Mutex),
+		}
+	}
+	return
+}
+
+// new one: 补齐未设置的发送队列与关闭通知
+func NewConnWs(c *ConnWs) (n *ConnWs) {
+	if c != nil {
+		n = c
+	} else {
+		n = new(ConnWs)
 	}
+	n.init()
 	return
 }
 
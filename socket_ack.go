@@ -0,0 +1,219 @@
+package response
+
+import (
+	"github.com/suboat/go-response/log"
+	"github.com/suboat/go-response/session"
+
+	"encoding/json"
+	"time"
+)
+
+const (
+	// 协议方法: 客户端确认推送, 请求 {"Method": "ACK", "Data": {"id": "..."}}
+	RequestCrudAck = "ACK"
+
+	// 请求data中消息id的字段名
+	RequestTagId = "id"
+)
+
+var (
+	AckRetryBase   = time.Second * 5 // 第一次重发的间隔, 之后每次加倍
+	AckRetryMax    = time.Minute * 5 // 重发间隔上限
+	AckMaxAttempts = 5               // 发送多少次仍未确认时转入死信
+	AckTtl         = time.Hour * 24  // 未确认的最长保存时间, 含离线时间
+	AckTick        = time.Second     // 检查重发的周期
+)
+
+// 待确认的推送
+type AckMessage struct {
+	Id       string
+	Uid      string
+	Data     []byte
+	Attempts int       // 已发送次数
+	Created  time.Time //
+	Next     time.Time // 下次重发时间
+}
+
+// 死信: 多次发送仍未确认的推送
+type WsDeadLetterHook func(m *AckMessage)
+
+// 注册死信事件
+func (h *HubWs) OnDeadLetter(fn WsDeadLetterHook) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.onDeadLetter = append(h.onDeadLetter, fn)
+}
+
+// 须确认的推送: 分配消息id, 客户端以ACK确认, 未确认时按退避重发, 用户重连后再发
+// 每次发送都分配新的推送序号, SSE可以续传; 客户端以id去重
+// 只用于单节点: 待确认的推送与确认都只在本节点, 不经过代理与离线存储,
+// 用户连在其它节点时最终转入死信
+func (h *HubWs) PushAck(uid string, p *MessageWsPack) (id string, err error) {
+	var (
+		data []byte
+		now  = time.Now()
+	)
+	if presenceTracked(uid) == false {
+		err = ErrRequestDataType
+		return
+	}
+	p.Id, p.Ack = session.NewTokenId(), true
+	if data, err = json.Marshal(p); err != nil {
+		return
+	}
+	id = p.Id
+	m := &AckMessage{Id: id, Uid: uid, Data: data, Created: now, Next: now}
+
+	h.ackLock.Lock()
+	h.acks[id] = m
+	h.ackLock.Unlock()
+	h.ackOnce.Do(func() {
+		go h.ackLoop()
+	})
+
+	h.ackSend(uid, h.Conns(uid), m, now, true)
+	return
+}
+
+// 确认, 只接受该用户的连接的确认
+func (h *HubWs) Ack(uid string, id string) (ok bool) {
+	h.ackLock.Lock()
+	defer h.ackLock.Unlock()
+	if m := h.acks[id]; m != nil && m.Uid == uid {
+		delete(h.acks, id)
+		ok = true
+	}
+	return
+}
+
+// 未确认的推送数
+func (h *HubWs) AckPending(uid string) (n int) {
+	h.ackLock.Lock()
+	defer h.ackLock.Unlock()
+	for _, m := range h.acks {
+		if m.Uid == uid {
+			n++
+		}
+	}
+	return
+}
+
+// 发送, count时记录次数并推迟重发; 没有连接时等待重连
+func (h *HubWs) ackSend(uid string, conns []*ConnWs, m *AckMessage, now time.Time, count bool) {
+	if len(conns) == 0 || h.deliver(uid, conns, m.Data) == 0 || count == false {
+		return
+	}
+	h.ackLock.Lock()
+	m.Attempts++
+	m.Next = now.Add(ackBackoff(m.Attempts))
+	h.ackLock.Unlock()
+}
+
+// 第n次发送后的重发间隔
+func ackBackoff(n int) (d time.Duration) {
+	d = AckRetryBase
+	for i := 1; i < n && d < AckRetryMax; i++ {
+		d *= 2
+	}
+	if d > AckRetryMax {
+		d = AckRetryMax
+	}
+	return
+}
+
+// 重发到期的推送, 转出死信
+func (h *HubWs) ackRetry(now time.Time) {
+	var (
+		due  []*AckMessage
+		dead []*AckMessage
+	)
+	h.ackLock.Lock()
+	for id, m := range h.acks {
+		if now.Before(m.Next) {
+			continue
+		}
+		if m.Attempts >= AckMaxAttempts || now.Sub(m.Created) > AckTtl {
+			// 复制, 锁外记录日志与调用事件
+			delete(h.acks, id)
+			_m := *m
+			dead = append(dead, &_m)
+			continue
+		}
+		// 离线时等待重连
+		m.Next = now.Add(ackBackoff(m.Attempts))
+		due = append(due, m)
+	}
+	h.ackLock.Unlock()
+
+	for _, m := range due {
+		h.ackSend(m.Uid, h.Conns(m.Uid), m, now, true)
+	}
+	if len(dead) == 0 {
+		return
+	}
+	h.lock.RLock()
+	hooks := h.onDeadLetter
+	h.lock.RUnlock()
+	for _, m := range dead {
+		log.Warn("ws push dead letter: ", m.Uid, " ", m.Id, " attempts ", m.Attempts)
+		for _, fn := range hooks {
+			fn(m)
+		}
+	}
+}
+
+// 用户连接后发送其未确认的推送; 不计入次数, 也不推迟重发
+func (h *HubWs) flushAck(c *ConnWs, uid string) {
+	var (
+		lis []*AckMessage
+		now = time.Now()
+	)
+	h.ackLock.Lock()
+	for _, m := range h.acks {
+		if m.Uid == uid {
+			lis = append(lis, m)
+		}
+	}
+	h.ackLock.Unlock()
+	// 按创建顺序
+	for i := 1; i < len(lis); i++ {
+		for j := i; j > 0 && lis[j].Created.Before(lis[j-1].Created); j-- {
+			lis[j], lis[j-1] = lis[j-1], lis[j]
+		}
+	}
+	for _, m := range lis {
+		h.ackSend(uid, []*ConnWs{c}, m, now, false)
+	}
+}
+
+// 定时重发, Shutdown后退出
+func (h *HubWs) ackLoop() {
+	ticker := time.NewTicker(AckTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			h.ackRetry(now)
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+// 处理确认协议, 不是确认请求时返回nil
+func (c *ConnWs) serveAck(que *Request) (res *Response) {
+	if que.Method != RequestCrudAck {
+		return
+	}
+	var id = que.DataString(RequestTagId)
+	res = NewResponse(que)
+	if len(id) == 0 {
+		res.Error = ErrRequestDataType
+		return
+	}
+	if c.Hub.Ack(c.Uid, id) == false {
+		log.Debug("ws ack unknown: ", c.Uid, " ", id)
+	}
+	res.Data = map[string]string{RequestTagId: id}
+	return
+}
@@ -0,0 +1,211 @@
+package response
+
+import (
+	"github.com/suboat/go-response/log"
+
+	"encoding/json"
+	"sync"
+)
+
+// 跨节点消息的类型
+const (
+	BrokerKindAll   = iota // 0: 所有连接
+	BrokerKindUid          // 1: 用户
+	BrokerKindTopic        // 2: 主题
+)
+
+// 跨节点消息
+type BrokerMessage struct {
+	Node   string `json:"node"`   // 发出的节点, 节点收到自己的消息时忽略
+	Kind   int    `json:"kind"`   // BrokerKind*
+	Target string `json:"target"` // uid或主题
+	Data   []byte `json:"data"`
+}
+
+// 消息代理: hub把推送发布到代理, 再从代理接收其它节点的推送
+// 如redis pub/sub, nats; Subscribe的回调不应阻塞
+// 须确认的推送(PushAck)不经过代理, 只发给本节点的连接; 推送序号也只在本节点, 见Resume
+type Broker interface {
+	Publish(m *BrokerMessage) error
+	Subscribe(fn func(m *BrokerMessage)) (cancel func(), err error)
+}
+
+// 使用代理, 替换之前的代理
+func (h *HubWs) UseBroker(b Broker) (err error) {
+	var cancel func()
+	if cancel, err = b.Subscribe(h.brokerReceive); err != nil {
+		return
+	}
+	h.lock.Lock()
+	old := h.brokerCancel
+	h.broker, h.brokerCancel = b, cancel
+	h.lock.Unlock()
+	if old != nil {
+		old()
+	}
+	return
+}
+
+// 停止接收代理的消息
+func (h *HubWs) brokerStop() {
+	h.lock.Lock()
+	cancel := h.brokerCancel
+	h.broker, h.brokerCancel = nil, nil
+	h.lock.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// 发布到其它节点
+func (h *HubWs) brokerPublish(kind int, target string, data []byte) {
+	h.lock.RLock()
+	b := h.broker
+	h.lock.RUnlock()
+	if b == nil {
+		return
+	}
+	if err := b.Publish(&BrokerMessage{Node: h.Node, Kind: kind, Target: target, Data: data}); err != nil {
+		log.Error("broker publish: ", err)
+	}
+}
+
+// 收到其它节点的推送, 只发给本节点的连接
+func (h *HubWs) brokerReceive(m *BrokerMessage) {
+	if m.Node == h.Node {
+		return
+	}
+	switch m.Kind {
+	case BrokerKindAll:
+		h.broadcastLocal(nil, m.Data)
+	case BrokerKindUid:
+		h.broadcastLocal(&m.Target, m.Data)
+	case BrokerKindTopic:
+		h.publishLocal(m.Target, m.Data)
+	default:
+		log.Warn("broker unknown kind: ", m.Kind, " from ", m.Node)
+	}
+}
+
+// 进程内的代理: 同步送达所有订阅者, 供单机与共享一个代理的多个hub
+type BrokerMemory struct {
+	lock *sync.RWMutex
+	subs map[int]func(m *BrokerMessage)
+	next int
+}
+
+func (b *BrokerMemory) Publish(m *BrokerMessage) (err error) {
+	var subs []func(m *BrokerMessage)
+	b.lock.RLock()
+	for _, fn := range b.subs {
+		subs = append(subs, fn)
+	}
+	b.lock.RUnlock()
+	for _, fn := range subs {
+		fn(m)
+	}
+	return
+}
+
+func (b *BrokerMemory) Subscribe(fn func(m *BrokerMessage)) (cancel func(), err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	id := b.next
+	b.next++
+	b.subs[id] = fn
+	cancel = func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		delete(b.subs, id)
+	}
+	return
+}
+
+// 测试用: 在一个进程中模拟多个节点, 消息经json编码后按订阅者异步送达
+type BrokerLoopback struct {
+	lock    *sync.Mutex
+	subs    map[int]chan []byte
+	next    int
+	pending sync.WaitGroup // 未送达的消息
+}
+
+func (b *BrokerLoopback) Publish(m *BrokerMessage) (err error) {
+	var data []byte
+	if data, err = json.Marshal(m); err != nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, ch := range b.subs {
+		b.pending.Add(1)
+		ch <- data
+	}
+	return
+}
+
+func (b *BrokerLoopback) Subscribe(fn func(m *BrokerMessage)) (cancel func(), err error) {
+	var (
+		ch   = make(chan []byte, 1024)
+		once sync.Once
+	)
+	b.lock.Lock()
+	id := b.next
+	b.next++
+	b.subs[id] = ch
+	b.lock.Unlock()
+
+	go func() {
+		for data := range ch {
+			m := new(BrokerMessage)
+			if _err := json.Unmarshal(data, m); _err != nil {
+				log.Error("broker loopback: ", _err)
+			} else {
+				fn(m)
+			}
+			b.pending.Done()
+		}
+	}()
+	cancel = func() {
+		once.Do(func() {
+			b.lock.Lock()
+			defer b.lock.Unlock()
+			delete(b.subs, id)
+			close(ch)
+		})
+	}
+	return
+}
+
+// 等待已发布的消息全部送达
+func (b *BrokerLoopback) Flush() {
+	b.pending.Wait()
+}
+
+// new one
+func NewBrokerMemory(b *BrokerMemory) (n *BrokerMemory) {
+	// placehold
+	if b != nil {
+		n = b
+		return
+	}
+
+	n = &BrokerMemory{
+		lock: new(sync.RWMutex),
+		subs: make(map[int]func(m *BrokerMessage)),
+	}
+	return
+}
+
+func NewBrokerLoopback(b *BrokerLoopback) (n *BrokerLoopback) {
+	// placehold
+	if b != nil {
+		n = b
+		return
+	}
+
+	n = &BrokerLoopback{
+		lock: new(sync.Mutex),
+		subs: make(map[int]chan []byte),
+	}
+	return
+}
@@ -0,0 +1,219 @@
+package response
+
+import (
+	"github.com/suboat/go-response/log"
+
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	OfflineTtl = time.Hour * 72 // 离线消息有效期
+	OfflineMax = 100            // 每个用户最多保存的离线消息, 超过时丢弃最旧的
+)
+
+// 离线消息
+type OfflineMessage struct {
+	Uid     string    `json:"uid"`
+	Data    []byte    `json:"data"`
+	Created time.Time `json:"created"`
+	Exp     time.Time `json:"exp"`
+}
+
+// 离线消息存储
+type OfflineStore interface {
+	Push(m *OfflineMessage) error                      // 超过OfflineMax时丢弃最旧的
+	Pop(uid string) (lis []*OfflineMessage, err error) // 按时间顺序取出未过期的消息并删除
+}
+
+// 内存存储
+type OfflineStoreMemory struct {
+	lock *sync.Mutex
+	Uid  map[string][]*OfflineMessage `json:"uid"`
+}
+
+func (s *OfflineStoreMemory) Push(m *OfflineMessage) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.gc()
+	lis := append(s.Uid[m.Uid], m)
+	if OfflineMax > 0 && len(lis) > OfflineMax {
+		lis = lis[len(lis)-OfflineMax:]
+	}
+	s.Uid[m.Uid] = lis
+	return
+}
+
+func (s *OfflineStoreMemory) Pop(uid string) (lis []*OfflineMessage, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for _, m := range s.Uid[uid] {
+		if now.Before(m.Exp) {
+			lis = append(lis, m)
+		}
+	}
+	delete(s.Uid, uid)
+	return
+}
+
+// 清理过期消息, 需持有锁
+func (s *OfflineStoreMemory) gc() {
+	now := time.Now()
+	for uid, lis := range s.Uid {
+		i := 0
+		for i < len(lis) && now.After(lis[i].Exp) {
+			i++
+		}
+		if i == len(lis) {
+			delete(s.Uid, uid)
+		} else if i > 0 {
+			s.Uid[uid] = lis[i:]
+		}
+	}
+}
+
+// 文件存储: 内存存储加json文件, 每次变化后写入
+type OfflineStoreFile struct {
+	*OfflineStoreMemory
+	Path string
+
+	saveLock *sync.Mutex
+}
+
+func (s *OfflineStoreFile) Push(m *OfflineMessage) (err error) {
+	if err = s.OfflineStoreMemory.Push(m); err != nil {
+		return
+	}
+	return s.save()
+}
+
+func (s *OfflineStoreFile) Pop(uid string) (lis []*OfflineMessage, err error) {
+	if lis, err = s.OfflineStoreMemory.Pop(uid); err != nil || len(lis) == 0 {
+		return
+	}
+	err = s.save()
+	return
+}
+
+// 写入临时文件后改名, 避免写一半
+func (s *OfflineStoreFile) save() (err error) {
+	var b []byte
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	s.lock.Lock()
+	b, err = json.Marshal(s.OfflineStoreMemory)
+	s.lock.Unlock()
+	if err != nil {
+		return
+	}
+	tmp := s.Path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+// 用户离线时保存推送, 返回是否已保存
+// 与addOnline互斥: 保存的推送由之后上线的连接取走, 上线后的推送排在离线推送之后
+func (h *HubWs) storeOffline(uid string, data []byte) (ok bool) {
+	if h.OfflineStore == nil || presenceTracked(uid) == false {
+		return
+	}
+	sh := h.shard(uid)
+	sh.offline.Lock()
+	defer sh.offline.Unlock()
+	if h.OfflineCheck != nil {
+		if h.OfflineCheck(uid) == false {
+			return
+		}
+	} else {
+		// 用代理时本节点无法判断
+		h.lock.RLock()
+		b := h.broker
+		h.lock.RUnlock()
+		if b != nil || h.count(uid) > 0 {
+			return
+		}
+	}
+	now := time.Now()
+	if err := h.OfflineStore.Push(&OfflineMessage{Uid: uid, Data: data, Created: now, Exp: now.Add(OfflineTtl)}); err != nil {
+		log.Error("offline store: ", err)
+		return
+	}
+	return true
+}
+
+// 加入连接表并发送离线消息
+func (h *HubWs) addOnline(c *ConnWs, uid string) {
+	sh := h.shard(uid)
+	sh.offline.Lock()
+	defer sh.offline.Unlock()
+	h.add(c, uid)
+	h.flushOffline(c, uid)
+}
+
+// 连接登记或换用户后按顺序发送离线消息, 需持有分片的offline锁
+// 队列已满时未发送的消息放回存储
+func (h *HubWs) flushOffline(c *ConnWs, uid string) {
+	if h.OfflineStore == nil || presenceTracked(uid) == false {
+		return
+	}
+	lis, err := h.OfflineStore.Pop(uid)
+	if err != nil {
+		log.Error("offline store: ", err)
+		return
+	}
+	for i, m := range lis {
+		if h.deliver(uid, []*ConnWs{c}, m.Data) == 0 {
+			for _, _m := range lis[i:] {
+				if err = h.OfflineStore.Push(_m); err != nil {
+					log.Error("offline store: ", err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// new one
+func NewOfflineStoreMemory(s *OfflineStoreMemory) (n *OfflineStoreMemory) {
+	// placehold
+	if s != nil {
+		n = s
+		return
+	}
+
+	n = &OfflineStoreMemory{
+		lock: new(sync.Mutex),
+		Uid:  make(map[string][]*OfflineMessage),
+	}
+	return
+}
+
+// 从文件读取, 文件不存在时新建
+func NewOfflineStoreFile(path string) (n *OfflineStoreFile, err error) {
+	var b []byte
+	n = &OfflineStoreFile{
+		OfflineStoreMemory: NewOfflineStoreMemory(nil),
+		Path:               path,
+		saveLock:           new(sync.Mutex),
+	}
+	if b, err = ioutil.ReadFile(path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(b, n.OfflineStoreMemory); err != nil {
+		return
+	}
+	if n.Uid == nil {
+		n.Uid = make(map[string][]*OfflineMessage)
+	}
+	n.gc()
+	return
+}
@@ -0,0 +1,144 @@
+package response
+
+import (
+	"github.com/suboat/go-response/log"
+	"github.com/suboat/go-response/session"
+
+	"encoding/json"
+	"time"
+)
+
+var (
+	// 用户的在线状态主题, 如presence:uid; 订阅须通过AuthorizeTopic
+	PresenceTopicPrefix = "presence:"
+)
+
+// 在线状态
+type WsPresence struct {
+	Uid      string    `json:"uid"`
+	Online   bool      `json:"online"`
+	Conns    int       `json:"conns"`    // 在线的连接数
+	Since    time.Time `json:"since"`    // 最近一次上线时间
+	LastSeen time.Time `json:"lastSeen"` // 在线时为当前时间, 离线时为最近一次下线时间
+}
+
+// 在线状态变化事件
+type WsPresenceHook func(p WsPresence)
+
+// 关注某个用户在线状态的uid, 如好友; 在状态变化时调用, 不应阻塞
+type WsPresenceWatchers func(uid string) []string
+
+// 注册在线状态变化事件
+func (h *HubWs) OnPresence(fn WsPresenceHook) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.onPresence = append(h.onPresence, fn)
+}
+
+// 设置关注者, 状态变化以MessageWsTypeLogin, MessageWsTypeLogout推送给他们
+func (h *HubWs) SetPresenceWatchers(fn WsPresenceWatchers) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.presenceWatchers = fn
+}
+
+// 用户的连接数
+func (h *HubWs) count(uid string) int {
+	sh := h.shard(uid)
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+	return len(sh.conns[uid])
+}
+
+// 查询在线状态
+func (h *HubWs) Presence(uid string) (p WsPresence) {
+	h.presenceLock.Lock()
+	defer h.presenceLock.Unlock()
+	if _p := h.presence[uid]; _p != nil {
+		p = *_p
+	}
+	p.Uid = uid
+	if p.Conns = h.count(uid); p.Online {
+		p.LastSeen = time.Now()
+	}
+	return
+}
+
+// 是否在线
+func (h *HubWs) Online(uid string) bool {
+	return h.count(uid) > 0
+}
+
+// 在线的用户, 不含游客
+func (h *HubWs) OnlineUids() (uids []string) {
+	for _, sh := range h.shards {
+		sh.lock.RLock()
+		for uid, uConns := range sh.conns {
+			if len(uConns) > 0 && presenceTracked(uid) {
+				uids = append(uids, uid)
+			}
+		}
+		sh.lock.RUnlock()
+	}
+	return
+}
+
+// 游客与未登录连接不记录在线状态
+func presenceTracked(uid string) bool {
+	return len(uid) > 0 && uid != session.GuestUid
+}
+
+// 连接加入或离开后检查用户的在线状态, 变化时发出事件
+// 在presenceLock中以实际连接数为准, 状态不会乱序; 事件与推送在锁外发出, 并发上下线时以Presence为准
+func (h *HubWs) presenceUpdate(uid string) {
+	if presenceTracked(uid) == false {
+		return
+	}
+	var now = time.Now()
+	h.presenceLock.Lock()
+	n := h.count(uid)
+	p := h.presence[uid]
+	if p == nil {
+		p = &WsPresence{Uid: uid}
+		h.presence[uid] = p
+	}
+	if p.Online == (n > 0) {
+		h.presenceLock.Unlock()
+		return
+	}
+	p.Online = n > 0
+	if p.Online {
+		p.Since = now
+	}
+	p.LastSeen = now
+	ev := *p
+	ev.Conns = n
+	h.lock.RLock()
+	hooks, watchers := append([]WsPresenceHook{}, h.onPresence...), h.presenceWatchers
+	h.lock.RUnlock()
+	h.presenceLock.Unlock()
+
+	for _, fn := range hooks {
+		fn(ev)
+	}
+
+	// 推送; 状态已过时, 不存离线消息
+	category := MessageWsTypeLogout
+	if ev.Online {
+		category = MessageWsTypeLogin
+	}
+	pack := NewMessageWsPack(nil)
+	pack.MessageLis = append(pack.MessageLis, &MessageWs{Category: category, Content: uid})
+	data, err := json.Marshal(pack)
+	if err != nil {
+		log.Error("presence pack: ", err)
+		return
+	}
+	if watchers != nil {
+		for _, w := range watchers(uid) {
+			w := w
+			h.broadcastOnline(&w, data)
+		}
+	}
+	h.Publish(PresenceTopicPrefix+uid, data)
+}
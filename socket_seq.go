@@ -0,0 +1,234 @@
+package response
+
+import (
+	"github.com/suboat/go-response/log"
+
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 协议方法: 重连后取回错过的推送, 请求 {"Method": "RESUME", "Data": {"seq": 12}}
+	// 也可在升级时带参数 ?seq=12
+	RequestCrudResume = "RESUME"
+
+	// 请求data与升级参数中序号的字段名
+	RequestTagSeq = "seq"
+)
+
+var (
+	SeqBufferSize = 100              // 每个用户保留的最近推送数
+	SeqBufferTtl  = time.Minute * 30 // 用户多久没有推送后丢弃缓冲的推送, 序号保留
+)
+
+// 用户的推送序号与最近的推送
+type seqBuffer struct {
+	lock *sync.Mutex
+	seq  uint64     // 最新序号
+	lis  []seqEntry // 按序号, 最多SeqBufferSize
+	last time.Time  // 最近推送时间
+}
+
+type seqEntry struct {
+	seq  uint64
+	data []byte
+}
+
+// 用户的缓冲, 新建时清理长期没有推送的
+// 序号一直保留, 否则在线或重连的客户端会把新推送当作已收到
+func (h *HubWs) seqBuffer(uid string, create bool) (b *seqBuffer) {
+	var (
+		now = time.Now()
+		lis []*seqBuffer
+	)
+	h.seqLock.Lock()
+	if b = h.seqs[uid]; b != nil || create == false {
+		h.seqLock.Unlock()
+		return
+	}
+	b = &seqBuffer{lock: new(sync.Mutex), last: now}
+	h.seqs[uid] = b
+	if now.Sub(h.seqGc) > SeqBufferTtl/2 {
+		h.seqGc = now
+		for _, _b := range h.seqs {
+			lis = append(lis, _b)
+		}
+	}
+	h.seqLock.Unlock()
+
+	// 不在seqLock中取缓冲的锁
+	for _, _b := range lis {
+		_b.lock.Lock()
+		if now.Sub(_b.last) > SeqBufferTtl {
+			_b.lis = nil
+		}
+		_b.lock.Unlock()
+	}
+	return
+}
+
+// 在json对象前插入序号: {"seq":n,...}
+func seqWrap(seq uint64, data []byte) []byte {
+	d := bytes.TrimLeft(data, " \t\r\n")
+	if len(d) < 2 || d[0] != '{' {
+		return data
+	}
+	w := make([]byte, 0, len(d)+24)
+	w = append(w, `{"seq":`...)
+	w = strconv.AppendUint(w, seq, 10)
+	if rest := bytes.TrimLeft(d[1:], " \t\r\n"); len(rest) > 0 && rest[0] != '}' {
+		w = append(w, ',')
+	}
+	return append(w, d[1:]...)
+}
+
+// 按用户编号并发送, 返回放入队列的连接数
+// 游客与未登录连接不编号; 即使用户没有连接也记入缓冲, 供重连后取回
+func (h *HubWs) deliver(uid string, conns []*ConnWs, data []byte) (n int) {
+	if presenceTracked(uid) == false {
+		for _, c := range conns {
+			if c.SendBytes(data) {
+				n++
+			}
+		}
+		return
+	}
+	b := h.seqBuffer(uid, true)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.seq++
+	data = seqWrap(b.seq, data)
+	b.lis = append(b.lis, seqEntry{seq: b.seq, data: data})
+	if len(b.lis) > SeqBufferSize {
+		b.lis = append([]seqEntry{}, b.lis[len(b.lis)-SeqBufferSize:]...)
+	}
+	b.last = time.Now()
+	// 持有锁发送, 同一用户的序号按顺序到达
+	for _, c := range conns {
+		if c.SendBytes(data) {
+			c.seqMark(b.seq)
+			n++
+		}
+	}
+	return
+}
+
+// 记录已发送的序号, 第一次Resume后不再记录
+func (c *ConnWs) seqMark(seq uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.seqResumed == false && len(c.seqSent) < SeqBufferSize {
+		c.seqSent = append(c.seqSent, seq)
+	}
+}
+
+// 取出已发送的序号, 之后不再记录
+func (c *ConnWs) seqTake() (skip map[uint64]bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	skip = make(map[uint64]bool, len(c.seqSent))
+	for _, seq := range c.seqSent {
+		skip[seq] = true
+	}
+	c.seqSent, c.seqResumed = nil, true
+	return
+}
+
+// 按用户分组后发送
+func (h *HubWs) deliverConns(conns []*ConnWs, data []byte) (n int) {
+	var group = make(map[string][]*ConnWs)
+	for _, c := range conns {
+		uid := c.GetUid()
+		group[uid] = append(group[uid], c)
+	}
+	for uid, uConns := range group {
+		n += h.deliver(uid, uConns, data)
+	}
+	return
+}
+
+// 当前序号
+func (h *HubWs) Seq(uid string) (seq uint64) {
+	if b := h.seqBuffer(uid, false); b != nil {
+		b.lock.Lock()
+		seq = b.seq
+		b.lock.Unlock()
+	}
+	return
+}
+
+// 重连后补发last之后的推送; 已被挤出缓冲时发送MessageWsTypeResync, 返回true
+// 登记时已发送的推送, 如离线消息, 不重复发送
+// 序号与缓冲只在本节点: 用代理时须让同一用户连到同一节点, 否则续传的范围不对
+func (h *HubWs) Resume(c *ConnWs, last uint64) (gap bool) {
+	var (
+		uid  = c.GetUid()
+		cur  uint64
+		b    = h.seqBuffer(uid, false)
+		skip map[uint64]bool
+	)
+	if b == nil {
+		if last > 0 {
+			return h.resync(c, 0)
+		}
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	skip = c.seqTake()
+	if cur = b.seq; last == cur {
+		return
+	}
+	// 客户端的序号无效, 如服务重启; 或已被挤出
+	if last > cur || len(b.lis) == 0 || b.lis[0].seq > last+1 {
+		return h.resync(c, cur)
+	}
+	for _, e := range b.lis {
+		if e.seq > last && skip[e.seq] == false {
+			c.SendBytes(e.data)
+		}
+	}
+	return
+}
+
+// 通知客户端重新同步, content为当前序号
+func (h *HubWs) resync(c *ConnWs, cur uint64) bool {
+	log.Debug("ws resync: ", c.GetUid(), " ", cur)
+	pack := NewMessageWsPack(nil)
+	pack.MessageLis = append(pack.MessageLis, &MessageWs{Category: MessageWsTypeResync, Content: strconv.FormatUint(cur, 10)})
+	if data, err := json.Marshal(pack); err == nil {
+		c.SendBytes(data)
+	}
+	return true
+}
+
+// 处理重连协议, 不是重连请求时返回nil
+func (c *ConnWs) serveResume(que *Request) (res *Response) {
+	if que.Method != RequestCrudResume {
+		return
+	}
+	var (
+		last uint64
+		err  error
+	)
+	res = NewResponse(que)
+	m, _ := que.Data.(map[string]interface{})
+	switch v := m[RequestTagSeq].(type) {
+	case float64:
+		last = uint64(v)
+	case string:
+		if last, err = strconv.ParseUint(v, 10, 64); err != nil {
+			res.Error = ErrRequestDataType
+			return
+		}
+	default:
+		res.Error = ErrRequestDataType
+		return
+	}
+	gap := c.Hub.Resume(c, last)
+	res.Data = map[string]interface{}{RequestTagSeq: c.Hub.Seq(c.Uid), "gap": gap}
+	return
+}
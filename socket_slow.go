@@ -0,0 +1,189 @@
+package response
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/suboat/go-response/log"
+
+	"sync/atomic"
+)
+
+// 慢速连接: 发送队列已满时的处理
+const (
+	WsSlowDropNewest = iota // 0: 丢弃新消息
+	WsSlowDropOldest        // 1: 丢弃队列中最旧的消息
+	WsSlowOverflow          // 2: 放入有界的溢出队列, 溢出队列也满时丢弃新消息
+	WsSlowDisconnect        // 3: 丢弃新消息, 累计MaxDrops次后断开
+)
+
+var (
+	// 连接与hub都未设置时使用
+	WsSlowPolicyDefault = &WsSlowPolicy{Mode: WsSlowDropNewest}
+)
+
+// 慢速连接策略
+type WsSlowPolicy struct {
+	Mode     int // WsSlow*
+	Overflow int // WsSlowOverflow: 溢出队列长度
+	MaxDrops int // WsSlowDisconnect: 累计丢弃多少次后断开, 不大于0时为1
+}
+
+// 发送统计
+type WsStats struct {
+	Sent         uint64 `json:"sent"`         // 已放入队列
+	Dropped      uint64 `json:"dropped"`      // 已丢弃
+	Disconnected uint64 `json:"disconnected"` // hub: 因慢速断开的连接数
+	Queued       int    `json:"queued"`       // 连接: 队列与溢出队列中的消息数
+}
+
+// 慢速连接事件: dropped为该连接累计丢弃数, disconnect表示将被断开
+type WsSlowHook func(c *ConnWs, dropped uint64, disconnect bool)
+
+// 连接的策略: 连接, hub, 默认
+func (c *ConnWs) slowPolicy() (p *WsSlowPolicy) {
+	if p = c.SlowPolicy; p == nil && c.Hub != nil {
+		p = c.Hub.SlowPolicy
+	}
+	if p == nil {
+		p = WsSlowPolicyDefault
+	}
+	return
+}
+
+// 按策略放入发送队列, 不阻塞
+func (c *ConnWs) enqueue(data []byte) (ok bool) {
+	var (
+		p          = c.slowPolicy()
+		dropped    uint64
+		disconnect bool
+	)
+	c.qlock.Lock()
+	// 溢出队列不为空时追加到其后, 保持顺序
+	if len(c.overflow) == 0 {
+		select {
+		case c.Send <- data:
+			ok = true
+		default:
+		}
+	}
+	if ok == false {
+		switch p.Mode {
+		case WsSlowDropOldest:
+			select {
+			case <-c.Send:
+			default:
+			}
+			select {
+			case c.Send <- data:
+				ok = true
+			default:
+			}
+		case WsSlowOverflow:
+			if len(c.overflow) < p.Overflow {
+				c.overflow = append(c.overflow, data)
+				c.qlock.Unlock()
+				atomic.AddUint64(&c.sent, 1)
+				c.hubStat(1, 0)
+				return true
+			}
+		}
+		dropped = atomic.AddUint64(&c.dropped, 1)
+		if p.Mode == WsSlowDisconnect && (p.MaxDrops <= 0 || dropped >= uint64(p.MaxDrops)) {
+			// 只断开一次
+			c.slowOnce.Do(func() {
+				disconnect = true
+			})
+		}
+	}
+	c.qlock.Unlock()
+
+	if ok {
+		atomic.AddUint64(&c.sent, 1)
+		c.hubStat(1, 0)
+	}
+	if dropped == 0 {
+		return
+	}
+	c.hubStat(0, 1)
+	log.Debug("ws slow consumer: ", c.GetUid(), " dropped ", dropped)
+	if c.Hub != nil {
+		for _, fn := range c.Hub.slowHooks() {
+			fn(c, dropped, disconnect)
+		}
+	}
+	if disconnect {
+		c.slowDisconnect()
+	}
+	return
+}
+
+// 把溢出队列移入发送队列, 返回移入的数量; WritePump取走消息后调用
+func (c *ConnWs) flushOverflow() (n int) {
+	c.qlock.Lock()
+	defer c.qlock.Unlock()
+	for len(c.overflow) > 0 {
+		select {
+		case c.Send <- c.overflow[0]:
+			c.overflow[0] = nil
+			c.overflow = c.overflow[1:]
+			n++
+		default:
+			return
+		}
+	}
+	c.overflow = nil
+	return
+}
+
+// 因慢速断开
+func (c *ConnWs) slowDisconnect() {
+	log.Warn("ws slow consumer disconnected: ", c.GetUid())
+	if c.Hub != nil {
+		atomic.AddUint64(&c.Hub.disconnected, 1)
+	}
+	// WriteControl可能等待WsWriteWait, 不阻塞推送方
+	go c.Close(websocket.CloseTryAgainLater, "slow consumer")
+}
+
+// hub统计
+func (c *ConnWs) hubStat(sent uint64, dropped uint64) {
+	if c.Hub == nil {
+		return
+	}
+	if sent > 0 {
+		atomic.AddUint64(&c.Hub.sent, sent)
+	}
+	if dropped > 0 {
+		atomic.AddUint64(&c.Hub.dropped, dropped)
+	}
+}
+
+// 连接的发送统计
+func (c *ConnWs) Stats() (s WsStats) {
+	s.Sent = atomic.LoadUint64(&c.sent)
+	s.Dropped = atomic.LoadUint64(&c.dropped)
+	c.qlock.Lock()
+	s.Queued = len(c.Send) + len(c.overflow)
+	c.qlock.Unlock()
+	return
+}
+
+// hub的发送统计
+func (h *HubWs) Stats() (s WsStats) {
+	s.Sent = atomic.LoadUint64(&h.sent)
+	s.Dropped = atomic.LoadUint64(&h.dropped)
+	s.Disconnected = atomic.LoadUint64(&h.disconnected)
+	return
+}
+
+// 注册慢速连接事件, 在推送方的协程中调用, 不应阻塞
+func (h *HubWs) OnSlowConsumer(fn WsSlowHook) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.onSlow = append(h.onSlow, fn)
+}
+
+func (h *HubWs) slowHooks() []WsSlowHook {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.onSlow
+}
@@ -0,0 +1,688 @@
+package response
+
+import (
+	"github.com/suboat/go-response/session"
+
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 并发连接, 改uid, 广播, 注销; 用go test -race检查
+func Test_HubWsRace(t *testing.T) {
+	var (
+		h    = NewHubWs(nil)
+		wg   sync.WaitGroup
+		uids = []string{"a", "b", "c", "d"}
+	)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c := NewConnWs(&ConnWs{Uid: uids[(i+j)%len(uids)]})
+				if err := h.Register(c); err != nil {
+					t.Error(err)
+					return
+				}
+				// 模拟WritePump
+				go func() {
+					for {
+						select {
+						case <-c.Send:
+						case <-c.SendText:
+						case <-c.closed:
+							return
+						}
+					}
+				}()
+				if err := c.UidUpdate(uids[(i+j+1)%len(uids)]); err != nil {
+					t.Error(err)
+					return
+				}
+				h.BroadcastTo(&c.Uid, []byte("uid"))
+				h.BroadcastTo(nil, []byte("all"))
+				c.SendString("res")
+				h.Unregister(c)
+
+				// 注销后发送不阻塞也不panic
+				if c.SendBytes([]byte("x")) || c.SendString("x") {
+					t.Error("send after unregister")
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := h.Len(); n != 0 {
+		t.Fatal("conns left: ", n)
+	}
+}
+
+func Test_HubWsSlowPolicy(t *testing.T) {
+	var (
+		h     = NewHubWs(nil)
+		lag   = make(map[string]uint64)
+		kicks int
+	)
+	h.OnSlowConsumer(func(c *ConnWs, dropped uint64, disconnect bool) {
+		lag[c.Uid] = dropped
+		if disconnect {
+			kicks++
+		}
+	})
+	newConn := func(uid string, p *WsSlowPolicy) (c *ConnWs) {
+		c = NewConnWs(&ConnWs{Uid: uid, Send: make(chan []byte, 2), SlowPolicy: p})
+		if err := h.Register(c); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	recv := func(c *ConnWs) (s string) {
+		for {
+			select {
+			case b := <-c.Send:
+				c.flushOverflow()
+				s += string(b)
+			default:
+				return
+			}
+		}
+	}
+	push := func(c *ConnWs, msgs ...string) {
+		for _, m := range msgs {
+			c.SendBytes([]byte(m))
+		}
+	}
+
+	// 默认: 丢弃新消息
+	c := newConn("newest", nil)
+	push(c, "1", "2", "3")
+	if s := recv(c); s != "12" || lag["newest"] != 1 {
+		t.Fatal("drop newest: ", s, lag)
+	}
+
+	// 丢弃旧消息
+	c = newConn("oldest", &WsSlowPolicy{Mode: WsSlowDropOldest})
+	push(c, "1", "2", "3")
+	if s := recv(c); s != "23" || c.Stats().Dropped != 1 {
+		t.Fatal("drop oldest: ", s, c.Stats())
+	}
+
+	// 溢出队列
+	c = newConn("overflow", &WsSlowPolicy{Mode: WsSlowOverflow, Overflow: 2})
+	push(c, "1", "2", "3", "4", "5")
+	if st := c.Stats(); st.Queued != 4 || st.Dropped != 1 {
+		t.Fatal("overflow stats: ", st)
+	}
+	if s := recv(c); s != "1234" {
+		t.Fatal("overflow: ", s)
+	}
+
+	// 累计丢弃后断开
+	c = newConn("kick", &WsSlowPolicy{Mode: WsSlowDisconnect, MaxDrops: 2})
+	push(c, "1", "2", "3")
+	if kicks != 0 {
+		t.Fatal("kicked early")
+	}
+	push(c, "4", "5")
+	if kicks != 1 || h.Stats().Disconnected != 1 {
+		t.Fatal("disconnect: ", kicks, h.Stats())
+	}
+
+	if st := h.Stats(); st.Dropped != 1+1+1+3 {
+		t.Fatal("hub stats: ", st)
+	}
+}
+
+func Test_HubWsTopic(t *testing.T) {
+	var (
+		h   = NewHubWs(nil)
+		a   = NewConnWs(&ConnWs{Uid: "a"})
+		b   = NewConnWs(&ConnWs{Uid: "b"})
+		res = make(chan string, 8)
+		err error
+	)
+	for _, c := range []*ConnWs{a, b} {
+		if err = h.Register(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() {
+		for s := range a.SendText {
+			res <- s
+		}
+	}()
+
+	// 未注册授权时拒绝客户端订阅
+	if err = h.SubscribeClient(a, "news"); err != ErrSocketTopicDenied {
+		t.Fatal("no auth: ", err)
+	}
+	h.AuthorizeTopic(func(c *ConnWs, topic string) error {
+		if topic == "vip" && c.GetUid() != "b" {
+			return ErrSocketTopicDenied
+		}
+		return nil
+	})
+
+	// 协议消息
+	h.handlerBegin()
+	a.serve(1, []byte(`{"Method": "SUBSCRIBE", "RequestId": "1", "Data": {"topic": "news"}}`))
+	if s := <-res; strings.Contains(s, `"success":true`) == false {
+		t.Fatal("subscribe: ", s)
+	}
+	h.handlerBegin()
+	a.serve(1, []byte(`{"Method": "SUBSCRIBE", "RequestId": "2", "Data": {"topic": "vip"}}`))
+	if s := <-res; strings.Contains(s, ErrSocketTopicDenied.Error()) == false {
+		t.Fatal("subscribe vip: ", s)
+	}
+	if err = h.SubscribeClient(b, "vip"); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Subscribe(b, "news"); err != nil {
+		t.Fatal(err)
+	}
+
+	topic := "news"
+	if err = h.PushPack(&MessageWsPack{TargetOther: &topic}); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Send) != 1 || len(b.Send) != 1 {
+		t.Fatal("publish: ", len(a.Send), len(b.Send))
+	}
+	if n := h.Publish("vip", []byte("x")); n != 1 {
+		t.Fatal("publish vip: ", n)
+	}
+
+	// 换用户后不再允许的客户端订阅被退订, 服务端订阅保留
+	if err = b.UidUpdate("c"); err != nil {
+		t.Fatal(err)
+	}
+	if topics := b.Topics(); len(topics) != 1 || topics[0] != "news" {
+		t.Fatal("reauth: ", topics)
+	}
+
+	h.handlerBegin()
+	a.serve(1, []byte(`{"Method": "UNSUBSCRIBE", "RequestId": "3", "Data": {"topic": "news"}}`))
+	<-res
+	h.Unregister(b)
+	if n := len(h.Subscribers("news")); n != 0 {
+		t.Fatal("subscribers left: ", n)
+	}
+	h.Unregister(a)
+
+	// 与注销并发的服务端订阅不留下已注销的连接
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		c := NewConnWs(&ConnWs{Uid: "d"})
+		if err = h.Register(c); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			h.Subscribe(c, "race")
+		}()
+		go func() {
+			defer wg.Done()
+			h.Unregister(c)
+		}()
+	}
+	wg.Wait()
+	if n := len(h.Subscribers("race")); n != 0 {
+		t.Fatal("dead subscribers: ", n)
+	}
+}
+
+func Test_HubWsPresence(t *testing.T) {
+	var (
+		h      = NewHubWs(nil)
+		events []WsPresence
+		watch  = NewConnWs(&ConnWs{Uid: "w"})
+		a1     = NewConnWs(&ConnWs{Uid: "u"})
+		a2     = NewConnWs(&ConnWs{Uid: "u"})
+		guest  = NewConnWs(&ConnWs{Uid: session.GuestUid})
+	)
+	h.OnPresence(func(p WsPresence) {
+		events = append(events, p)
+	})
+	h.SetPresenceWatchers(func(uid string) []string {
+		return []string{"w"}
+	})
+	for _, c := range []*ConnWs{watch, a1, a2, guest} {
+		if err := h.Register(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-watch.Send // w自己上线, 关注者也是w
+	if len(events) != 2 || events[1].Uid != "u" || events[1].Online == false || h.Online("u") == false {
+		t.Fatal("online: ", events)
+	}
+	if b := <-watch.Send; strings.Contains(string(b), `"category":1,"content":"u"`) == false {
+		t.Fatal("login push: ", string(b))
+	}
+	if uids := h.OnlineUids(); len(uids) != 2 {
+		t.Fatal("online uids: ", uids)
+	}
+
+	// 还有连接时不算下线
+	h.Unregister(a1)
+	if len(events) != 2 || h.Presence("u").Conns != 1 {
+		t.Fatal("partial offline: ", events)
+	}
+	h.Unregister(a2)
+	if len(events) != 3 || events[2].Online || h.Presence("u").Online {
+		t.Fatal("offline: ", events)
+	}
+	if b := <-watch.Send; strings.Contains(string(b), `"category":2,"content":"u"`) == false {
+		t.Fatal("logout push: ", string(b))
+	}
+	if p := h.Presence("u"); p.LastSeen.IsZero() || p.Conns != 0 {
+		t.Fatal("last seen: ", p)
+	}
+
+	// 换用户
+	if err := guest.UidUpdate("u"); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 4 || events[3].Online == false {
+		t.Fatal("uid update: ", events)
+	}
+}
+
+// 事件在锁外调用, 离线的关注者不存在线状态
+func Test_HubWsPresenceHook(t *testing.T) {
+	var (
+		h     = NewHubWs(nil)
+		store = NewOfflineStoreMemory(nil)
+		c     = NewConnWs(&ConnWs{Uid: "u"})
+		got   []WsPresence
+	)
+	h.OfflineStore = store
+	h.OnPresence(func(p WsPresence) {
+		got = append(got, h.Presence(p.Uid))
+	})
+	h.SetPresenceWatchers(func(uid string) []string {
+		return []string{"offline-watcher"}
+	})
+	if err := h.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	h.Unregister(c)
+	if len(got) != 2 || got[0].Online == false || got[1].Online {
+		t.Fatal("hook: ", got)
+	}
+	if lis, _ := store.Pop("offline-watcher"); len(lis) != 0 {
+		t.Fatal("presence stored offline: ", len(lis))
+	}
+}
+
+func Test_HubWsBroker(t *testing.T) {
+	var (
+		b     = NewBrokerLoopback(nil)
+		nodes = []*HubWs{NewHubWs(nil), NewHubWs(nil), NewHubWs(nil)}
+		conns []*ConnWs
+	)
+	for i, h := range nodes {
+		if err := h.UseBroker(b); err != nil {
+			t.Fatal(err)
+		}
+		c := NewConnWs(&ConnWs{Uid: "u"})
+		if i == 2 {
+			c = NewConnWs(&ConnWs{Uid: "v"})
+		}
+		if err := h.Register(c); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	count := func() (n []int) {
+		b.Flush()
+		for _, c := range conns {
+			n = append(n, len(c.Send))
+			for len(c.Send) > 0 {
+				<-c.Send
+			}
+		}
+		return
+	}
+
+	// 用户: 每个节点上的连接各收到一次
+	uid := "u"
+	nodes[2].BroadcastTo(&uid, []byte("x"))
+	if n := count(); n[0] != 1 || n[1] != 1 || n[2] != 0 {
+		t.Fatal("uid: ", n)
+	}
+	// 所有连接
+	nodes[0].BroadcastTo(nil, []byte("x"))
+	if n := count(); n[0] != 1 || n[1] != 1 || n[2] != 1 {
+		t.Fatal("all: ", n)
+	}
+	// 主题
+	if err := nodes[1].Subscribe(conns[1], "news"); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[2].Subscribe(conns[2], "news"); err != nil {
+		t.Fatal(err)
+	}
+	if local := nodes[0].Publish("news", []byte("x")); local != 0 {
+		t.Fatal("local subscribers: ", local)
+	}
+	if n := count(); n[0] != 0 || n[1] != 1 || n[2] != 1 {
+		t.Fatal("topic: ", n)
+	}
+
+	// 关闭后不再接收
+	nodes[1].brokerStop()
+	nodes[0].BroadcastTo(nil, []byte("x"))
+	if n := count(); n[0] != 1 || n[1] != 0 || n[2] != 1 {
+		t.Fatal("stopped: ", n)
+	}
+
+	// 进程内代理
+	m := NewBrokerMemory(nil)
+	h1, h2 := NewHubWs(nil), NewHubWs(nil)
+	h1.UseBroker(m)
+	h2.UseBroker(m)
+	c := NewConnWs(&ConnWs{Uid: "u"})
+	h2.Register(c)
+	h1.BroadcastTo(&uid, []byte("x"))
+	if len(c.Send) != 1 {
+		t.Fatal("memory broker: ", len(c.Send))
+	}
+}
+
+func Test_HubWsOffline(t *testing.T) {
+	var (
+		h    = NewHubWs(nil)
+		path = filepath.Join(t.TempDir(), "offline.json")
+		uid  = "u"
+		max  = OfflineMax
+	)
+	OfflineMax = 3
+	defer func() { OfflineMax = max }()
+	store, err := NewOfflineStoreFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.OfflineStore = store
+	for _, m := range []string{"1", "2", "3", "4"} {
+		h.BroadcastTo(&uid, []byte(m))
+	}
+	// 过期的不发送
+	store.Push(&OfflineMessage{Uid: "v", Data: []byte("old"), Exp: time.Now().Add(-time.Second)})
+
+	// 重新读取文件
+	if store, err = NewOfflineStoreFile(path); err != nil {
+		t.Fatal(err)
+	}
+	h.OfflineStore = store
+	recv := func(c *ConnWs) (s string) {
+		for len(c.Send) > 0 {
+			s += string(<-c.Send)
+		}
+		return
+	}
+
+	// 登记时按顺序发送, 超过上限的最旧的已丢弃
+	c := NewConnWs(&ConnWs{Uid: uid})
+	if err = h.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	if s := recv(c); s != "234" {
+		t.Fatal("flush on register: ", s)
+	}
+	// 在线时直接发送
+	h.BroadcastTo(&uid, []byte("5"))
+	if s := recv(c); s != "5" {
+		t.Fatal("online: ", s)
+	}
+
+	// 换用户时发送
+	w := "w"
+	h.BroadcastTo(&w, []byte("6"))
+	if err = c.UidUpdate(w); err != nil {
+		t.Fatal(err)
+	}
+	if s := recv(c); s != "6" {
+		t.Fatal("flush on uid update: ", s)
+	}
+	if lis, _ := store.Pop("v"); len(lis) != 0 {
+		t.Fatal("expired: ", lis)
+	}
+}
+
+// 与登记并发的推送不滞留在存储中, 且按顺序到达
+func Test_HubWsOfflineRace(t *testing.T) {
+	var max = OfflineMax
+	OfflineMax = 200
+	defer func() { OfflineMax = max }()
+	for i := 0; i < 20; i++ {
+		var (
+			h    = NewHubWs(nil)
+			uid  = "r"
+			c    = NewConnWs(&ConnWs{Uid: uid})
+			done = make(chan struct{})
+		)
+		h.OfflineStore = NewOfflineStoreMemory(nil)
+		go func() {
+			defer close(done)
+			for n := 0; n < 100; n++ {
+				h.BroadcastTo(&uid, []byte(strconv.Itoa(n)))
+			}
+		}()
+		time.Sleep(time.Duration(i) * time.Microsecond * 10)
+		if err := h.Register(c); err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		if lis, _ := h.OfflineStore.Pop(uid); len(lis) != 0 {
+			t.Fatal("stuck in store: ", len(lis))
+		}
+		n := 0
+		for ; len(c.Send) > 0; n++ {
+			if s := string(<-c.Send); s != strconv.Itoa(n) {
+				t.Fatal("order: ", n, " ", s)
+			}
+		}
+		if n != 100 {
+			t.Fatal("received: ", n)
+		}
+	}
+}
+
+func Test_HubWsAck(t *testing.T) {
+	var (
+		h    = NewHubWs(nil)
+		c    = NewConnWs(&ConnWs{Uid: "u", Session: &session.Session{Uid: "u"}})
+		dead []*AckMessage
+		res  = make(chan string, 8)
+		now  = time.Now()
+	)
+	h.OnDeadLetter(func(m *AckMessage) {
+		dead = append(dead, m)
+	})
+	if err := h.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for s := range c.SendText {
+			res <- s
+		}
+	}()
+
+	id, err := h.PushAck("u", NewMessageWsPack(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 带推送序号, 可以续传
+	if b := <-c.Send; strings.HasPrefix(string(b), `{"seq":1,`) == false || strings.Contains(string(b), `"id":"`+id+`","ack":true`) == false {
+		t.Fatal("push: ", string(b))
+	}
+	// 未到时间不重发, 到期后重发
+	h.ackRetry(now)
+	if len(c.Send) != 0 {
+		t.Fatal("early retry")
+	}
+	h.ackRetry(now.Add(AckRetryBase + time.Second))
+	if len(c.Send) != 1 {
+		t.Fatal("retry: ", len(c.Send))
+	}
+	if b := <-c.Send; strings.HasPrefix(string(b), `{"seq":2,`) == false {
+		t.Fatal("retry seq: ", string(b))
+	}
+
+	// 其它用户不能确认
+	if h.Ack("v", id) {
+		t.Fatal("ack by other uid")
+	}
+	h.handlerBegin()
+	c.serve(1, []byte(`{"Method": "ACK", "RequestId": "1", "Data": {"id": "`+id+`"}}`))
+	<-res
+	if h.AckPending("u") != 0 {
+		t.Fatal("ack")
+	}
+
+	// 重连后再发, 多次未确认转入死信
+	h.Unregister(c)
+	if id, err = h.PushAck("u", NewMessageWsPack(nil)); err != nil {
+		t.Fatal(err)
+	}
+	c = NewConnWs(&ConnWs{Uid: "u"})
+	h.Register(c)
+	if len(c.Send) != 1 {
+		t.Fatal("reconnect: ", len(c.Send))
+	}
+	// 重连发送不计入次数
+	for i := 0; i < AckMaxAttempts; i++ {
+		c2 := NewConnWs(&ConnWs{Uid: "u"})
+		h.Register(c2)
+		h.Unregister(c2)
+	}
+	h.ackLock.Lock()
+	attempts := h.acks[id].Attempts
+	h.ackLock.Unlock()
+	if attempts != 0 {
+		t.Fatal("reconnect attempts: ", attempts)
+	}
+	for i := 1; i <= AckMaxAttempts+1; i++ {
+		<-c.Send
+		h.ackRetry(now.Add(AckRetryMax * time.Duration(i+1)))
+	}
+	if len(dead) != 1 || dead[0].Id != id || dead[0].Attempts != AckMaxAttempts {
+		t.Fatal("dead letter: ", dead)
+	}
+}
+
+func Test_HubWsSeq(t *testing.T) {
+	var (
+		h   = NewHubWs(nil)
+		uid = "u"
+		max = SeqBufferSize
+	)
+	SeqBufferSize = 3
+	defer func() { SeqBufferSize = max }()
+	recv := func(c *ConnWs) (lis []string) {
+		for len(c.Send) > 0 {
+			lis = append(lis, string(<-c.Send))
+		}
+		return
+	}
+
+	c := NewConnWs(&ConnWs{Uid: uid})
+	h.Register(c)
+	h.BroadcastJson(&uid, NewMessageWsPack(nil))
+	h.BroadcastTo(nil, []byte(`{}`))
+	if lis := recv(c); len(lis) != 2 || lis[0] != `{"seq":1,"messageLis":[]}` || lis[1] != `{"seq":2}` {
+		t.Fatal("seq: ", lis)
+	}
+
+	// 断线期间的推送在重连后补发
+	h.Unregister(c)
+	h.BroadcastTo(&uid, []byte(`{"n":3}`))
+	h.BroadcastTo(&uid, []byte(`{"n":4}`))
+	c = NewConnWs(&ConnWs{Uid: uid})
+	h.Register(c)
+	if gap := h.Resume(c, 2); gap {
+		t.Fatal("gap")
+	}
+	if lis := recv(c); len(lis) != 2 || lis[0] != `{"seq":3,"n":3}` || lis[1] != `{"seq":4,"n":4}` {
+		t.Fatal("replay: ", lis)
+	}
+	if h.Resume(c, 4) || len(c.Send) != 0 {
+		t.Fatal("up to date")
+	}
+
+	// 已被挤出缓冲
+	for i := 0; i < 5; i++ {
+		h.BroadcastTo(&uid, []byte(`{}`))
+	}
+	recv(c)
+	if gap := h.Resume(c, 4); gap == false {
+		t.Fatal("no gap")
+	}
+	if lis := recv(c); len(lis) != 1 || strings.Contains(lis[0], `"category":5,"content":"9"`) == false {
+		t.Fatal("resync: ", lis)
+	}
+
+	// 游客不编号
+	g := NewConnWs(&ConnWs{Uid: session.GuestUid})
+	h.Register(g)
+	h.BroadcastTo(nil, []byte(`{}`))
+	if lis := recv(g); len(lis) != 1 || lis[0] != `{}` {
+		t.Fatal("guest: ", lis)
+	}
+
+	// 登记时发送的离线消息不再补发
+	h = NewHubWs(nil)
+	h.OfflineStore = NewOfflineStoreMemory(nil)
+	c = NewConnWs(&ConnWs{Uid: uid})
+	h.Register(c)
+	h.BroadcastTo(&uid, []byte(`{"n":1}`))
+	h.Unregister(c)
+	h.BroadcastTo(&uid, []byte(`{"n":2}`))
+	c = NewConnWs(&ConnWs{Uid: uid})
+	h.Register(c)
+	h.Resume(c, 1)
+	if lis := recv(c); len(lis) != 1 || lis[0] != `{"seq":2,"n":2}` {
+		t.Fatal("offline replay: ", lis)
+	}
+}
+
+// 清理长期没有推送的缓冲时保留序号
+func Test_HubWsSeqGc(t *testing.T) {
+	var (
+		h   = NewHubWs(nil)
+		uid = "u"
+		c   = NewConnWs(&ConnWs{Uid: uid})
+	)
+	h.Register(c)
+	h.BroadcastTo(&uid, []byte(`{}`))
+	h.BroadcastTo(&uid, []byte(`{}`))
+	b := h.seqBuffer(uid, false)
+	b.lock.Lock()
+	b.last = time.Now().Add(-SeqBufferTtl * 2)
+	b.lock.Unlock()
+	h.seqLock.Lock()
+	h.seqGc = time.Time{}
+	h.seqLock.Unlock()
+
+	other := "v"
+	h.BroadcastTo(&other, []byte(`{}`))
+	b.lock.Lock()
+	n := len(b.lis)
+	b.lock.Unlock()
+	if n != 0 || h.Seq(uid) != 2 {
+		t.Fatal("gc: ", n, h.Seq(uid))
+	}
+	for len(c.Send) > 0 {
+		<-c.Send
+	}
+	h.BroadcastTo(&uid, []byte(`{}`))
+	if b := <-c.Send; string(b) != `{"seq":3}` {
+		t.Fatal("seq after gc: ", string(b))
+	}
+}
@@ -0,0 +1,205 @@
+package response
+
+import (
+	"github.com/suboat/go-response/log"
+
+	"encoding/json"
+)
+
+const (
+	// 协议方法: 客户端订阅与退订, 请求 {"Method": "SUBSCRIBE", "Data": {"topic": "..."}}
+	RequestCrudSubscribe   = "SUBSCRIBE"
+	RequestCrudUnsubscribe = "UNSUBSCRIBE"
+
+	// 请求data中主题的字段名
+	RequestTagTopic = "topic"
+)
+
+// 客户端订阅的授权, 返回错误则拒绝
+type WsTopicAuth func(c *ConnWs, topic string) error
+
+// 注册订阅授权, 客户端订阅须全部通过; 未注册时拒绝客户端订阅
+// 服务端以Subscribe订阅时不检查
+func (h *HubWs) AuthorizeTopic(fn WsTopicAuth) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.topicAuth = append(h.topicAuth, fn)
+}
+
+// 检查客户端订阅
+func (h *HubWs) topicAllowed(c *ConnWs, topic string) (err error) {
+	h.lock.RLock()
+	auth := h.topicAuth
+	h.lock.RUnlock()
+	if len(auth) == 0 {
+		err = ErrSocketTopicDenied
+		return
+	}
+	for _, fn := range auth {
+		if err = fn(c, topic); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// 服务端订阅, 不检查授权
+func (h *HubWs) Subscribe(c *ConnWs, topic string) (err error) {
+	return h.subscribe(c, topic, false)
+}
+
+// 客户端订阅, 须通过授权
+func (h *HubWs) SubscribeClient(c *ConnWs, topic string) (err error) {
+	if err = h.topicAllowed(c, topic); err != nil {
+		log.Debug("ws subscribe denied: ", c.GetUid(), " ", topic, " ", err)
+		return
+	}
+	return h.subscribe(c, topic, true)
+}
+
+func (h *HubWs) subscribe(c *ConnWs, topic string, client bool) (err error) {
+	if len(topic) == 0 {
+		err = ErrRequestDataType
+		return
+	}
+	h.topicLock.Lock()
+	defer h.topicLock.Unlock()
+	// 在锁内检查, 注销后的连接不会再加入
+	if c.Closed() {
+		err = ErrSocketHubClosed
+		return
+	}
+	if _, ok := h.topics[topic]; ok == false {
+		h.topics[topic] = make(map[*ConnWs]bool)
+	}
+	h.topics[topic][c] = true
+	c.lock.Lock()
+	if c.topics == nil {
+		c.topics = make(map[string]bool)
+	}
+	// 服务端订阅优先, 换用户时不重新检查
+	if old, ok := c.topics[topic]; ok == false || old {
+		c.topics[topic] = client
+	}
+	c.lock.Unlock()
+	return
+}
+
+// 退订
+func (h *HubWs) Unsubscribe(c *ConnWs, topic string) {
+	h.topicLock.Lock()
+	defer h.topicLock.Unlock()
+	if conns, ok := h.topics[topic]; ok {
+		delete(conns, c)
+		if len(conns) == 0 {
+			delete(h.topics, topic)
+		}
+	}
+	c.lock.Lock()
+	delete(c.topics, topic)
+	c.lock.Unlock()
+}
+
+// 退订连接的所有主题, 如注销时
+func (h *HubWs) unsubscribeAll(c *ConnWs) {
+	h.topicLock.Lock()
+	defer h.topicLock.Unlock()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for topic := range c.topics {
+		if conns, ok := h.topics[topic]; ok {
+			delete(conns, c)
+			if len(conns) == 0 {
+				delete(h.topics, topic)
+			}
+		}
+	}
+	c.topics = nil
+}
+
+// 换用户后重新检查客户端订阅, 不再允许的退订
+func (h *HubWs) reauthTopics(c *ConnWs) {
+	var topics []string
+	c.lock.RLock()
+	for topic, client := range c.topics {
+		if client {
+			topics = append(topics, topic)
+		}
+	}
+	c.lock.RUnlock()
+	for _, topic := range topics {
+		if h.topicAllowed(c, topic) != nil {
+			h.Unsubscribe(c, topic)
+		}
+	}
+}
+
+// 主题的订阅连接
+func (h *HubWs) Subscribers(topic string) (conns []*ConnWs) {
+	h.topicLock.RLock()
+	defer h.topicLock.RUnlock()
+	for c, _ := range h.topics[topic] {
+		conns = append(conns, c)
+	}
+	return
+}
+
+// 连接订阅的主题
+func (c *ConnWs) Topics() (topics []string) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for topic, _ := range c.topics {
+		topics = append(topics, topic)
+	}
+	return
+}
+
+// 发布到主题, 返回本节点放入队列的连接数; 有代理时同时发到其它节点
+func (h *HubWs) Publish(topic string, data []byte) (n int) {
+	n = h.publishLocal(topic, data)
+	h.brokerPublish(BrokerKindTopic, topic, data)
+	return
+}
+
+// 发给本节点的订阅连接
+func (h *HubWs) publishLocal(topic string, data []byte) (n int) {
+	return h.deliverConns(h.Subscribers(topic), data)
+}
+
+// 发布json
+func (h *HubWs) PublishJson(topic string, inf interface{}) (err error) {
+	var data = []byte{}
+	if data, err = json.Marshal(inf); err != nil {
+		return
+	}
+	h.Publish(topic, data)
+	return
+}
+
+// 推送: TargetOther为主题, 否则按TargetUid, 都为空时发给所有连接
+func (h *HubWs) PushPack(p *MessageWsPack) (err error) {
+	if p.TargetOther != nil {
+		return h.PublishJson(*p.TargetOther, p)
+	}
+	return h.BroadcastJson(p.TargetUid, p)
+}
+
+// 处理订阅协议, 不是订阅请求时返回nil
+func (c *ConnWs) serveTopic(que *Request) (res *Response) {
+	if que.Method != RequestCrudSubscribe && que.Method != RequestCrudUnsubscribe {
+		return
+	}
+	var topic = que.DataString(RequestTagTopic)
+	res = NewResponse(que)
+	if len(topic) == 0 {
+		res.Error = ErrRequestDataType
+		return
+	}
+	if que.Method == RequestCrudSubscribe {
+		res.Error = c.Hub.SubscribeClient(c, topic)
+	} else {
+		c.Hub.Unsubscribe(c, topic)
+	}
+	res.Data = map[string]string{RequestTagTopic: topic}
+	return
+}
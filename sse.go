@@ -0,0 +1,159 @@
+package response
+
+import (
+	"github.com/suboat/go-response/log"
+	"github.com/suboat/go-response/session"
+
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// SSE心跳间隔, 避免代理断开空闲连接
+	SseHeartbeat = time.Second * 15
+)
+
+// SSE传输: 推送以事件写出, id为推送序号, 客户端重连时以Last-Event-ID续传
+type ConnSse struct {
+	rw      http.ResponseWriter
+	flusher http.Flusher
+	kill    chan struct{} // 关闭
+	once    sync.Once
+}
+
+// 写一个事件, 带序号时写id
+func (t *ConnSse) WriteText(data []byte) (err error) {
+	var buf bytes.Buffer
+	if seq := seqOf(data); seq > 0 {
+		fmt.Fprintf(&buf, "id: %d\n", seq)
+	}
+	buf.WriteString("event: message\n")
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	return t.write(buf.Bytes())
+}
+
+func (t *ConnSse) write(b []byte) (err error) {
+	if _, err = t.rw.Write(b); err != nil {
+		return
+	}
+	t.flusher.Flush()
+	return
+}
+
+// 通知服务协程结束, 连接由http关闭
+func (t *ConnSse) Close(code int, text string) {
+	t.once.Do(func() {
+		close(t.kill)
+	})
+}
+
+// 取出seqWrap写入的序号, 没有时为0
+func seqOf(data []byte) (seq uint64) {
+	const prefix = `{"seq":`
+	if bytes.HasPrefix(data, []byte(prefix)) == false {
+		return
+	}
+	d := data[len(prefix):]
+	i := 0
+	for i < len(d) && d[i] >= '0' && d[i] <= '9' {
+		i++
+	}
+	seq, _ = strconv.ParseUint(string(d[:i]), 10, 64)
+	return
+}
+
+// SSE入口: 以se.Uid登记到hub, 与websocket连接一样接收推送与主题
+// 续传: Last-Event-ID头或seq参数
+func ServeSse(h *HubWs, rw http.ResponseWriter, req *http.Request, se *session.Session) {
+	var (
+		t  = &ConnSse{rw: rw, kill: make(chan struct{})}
+		c  *ConnWs
+		s  string
+		f  http.Flusher
+		ok bool
+	)
+	if f, ok = rw.(http.Flusher); ok == false {
+		http.Error(rw, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	t.flusher = f
+	if se == nil {
+		se = new(session.Session)
+	}
+	c = NewConnWs(&ConnWs{Uid: se.Uid, Session: se, Hub: h, Transport: t})
+	if err := h.Register(c); err != nil {
+		http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.Unregister(c)
+
+	hd := rw.Header()
+	hd.Set("Content-Type", "text/event-stream")
+	hd.Set("Cache-Control", "no-cache")
+	hd.Set("Connection", "keep-alive")
+	hd.Set("X-Accel-Buffering", "no") // nginx不缓冲
+	rw.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	// 续传
+	if s = req.Header.Get("Last-Event-ID"); len(s) == 0 {
+		s = req.URL.Query().Get(RequestTagSeq)
+	}
+	if len(s) > 0 {
+		if last, err := strconv.ParseUint(s, 10, 64); err == nil {
+			h.Resume(c, last)
+		}
+	}
+	c.servePush(req, t.kill, SseHeartbeat, func() error {
+		return t.write([]byte(": ping\n\n"))
+	}, func() {
+		t.write([]byte("event: close\ndata: server shutdown\n\n"))
+	})
+}
+
+// 推送循环, 供websocket以外的传输: 写出队列中的消息, 定时心跳, 关闭时发完剩余消息
+func (c *ConnWs) servePush(req *http.Request, kill chan struct{}, heartbeat time.Duration,
+	ping func() error, bye func()) {
+	ticker := time.NewTicker(heartbeat)
+	defer func() {
+		ticker.Stop()
+		close(c.done)
+	}()
+	for {
+		select {
+		case message := <-c.Send:
+			c.flushOverflow()
+			if err := c.writeText(message); err != nil {
+				log.Debug("push write: ", err)
+				return
+			}
+		case message := <-c.SendText:
+			if err := c.writeText([]byte(message)); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				return
+			}
+		case <-c.closing:
+			c.drain()
+			bye()
+			return
+		case <-c.closed:
+			return
+		case <-kill:
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
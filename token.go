@@ -0,0 +1,45 @@
+package response
+
+import (
+	"github.com/suboat/go-response/session"
+)
+
+const (
+	// 请求data中刷新token的字段名
+	RequestTagRefreshToken = "refreshToken"
+)
+
+// 从Data中取字符串字段, Data为json对象时有效
+func (r *Request) DataString(key string) (s string) {
+	if m, ok := r.Data.(map[string]interface{}); ok {
+		s, _ = m[key].(string)
+	}
+	return
+}
+
+// 刷新token: 用refreshToken换取新的一对token, http与websocket通用
+// 请求 {"data": {"refreshToken": "..."}}, 返回session.TokenPair
+func HandleTokenRefresh(req *Request) (res *Response) {
+	var (
+		refresh = req.DataString(RequestTagRefreshToken)
+		pair    *session.TokenPair
+		se      *session.Session
+	)
+	res = NewResponse(req)
+
+	if len(refresh) == 0 {
+		res.Error = ErrRequestDataType
+		return
+	}
+	if pair, res.Error = session.RefreshTokenPair(refresh); res.Error != nil {
+		return
+	}
+	// for ws: 以新token的会话更新当前连接, 作废或结束新token时一并生效
+	if se, res.Error = session.TokenToUid(pair.AccessToken); res.Error != nil {
+		return
+	}
+	res.Uid = se.Uid
+	res.Session = se
+	res.Data = pair
+	return
+}
@@ -0,0 +1,37 @@
+package response
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/suboat/go-response/session"
+
+	"encoding/json"
+	"testing"
+)
+
+// websocket刷新后连接使用新的会话
+func Test_HandleTokenRefresh(t *testing.T) {
+	var (
+		h    = NewHubWs(nil)
+		c    = NewConnWs(&ConnWs{Handler: HandleTokenRefresh, SendText: make(chan string, 1)})
+		pair *session.TokenPair
+		err  error
+	)
+	if pair, err = session.NewTokenPair(session.TokenKidUser, "refresh", session.SessionLevelNormal, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := json.Marshal(map[string]interface{}{"Method": "POST", "Data": map[string]string{RequestTagRefreshToken: pair.RefreshToken}})
+	h.handlerBegin()
+	c.serve(websocket.TextMessage, msg)
+	<-c.SendText
+
+	se := c.GetSession()
+	if c.GetUid() != "refresh" || se == nil || se.Uid != "refresh" || len(se.Jti) == 0 {
+		t.Fatal("session: ", se)
+	}
+	if old, _ := session.TokenToUid(pair.AccessToken); old != nil && old.Jti == se.Jti {
+		t.Fatal("old jti kept")
+	}
+}
@@ -0,0 +1,40 @@
+package response
+
+import (
+	"github.com/suboat/go-response/session"
+)
+
+const (
+	// 未登录时, 请求data中验证码目标的字段名, 如手机号
+	RequestTagVerifyTarget = "target"
+)
+
+// 验证码的目标: 已登录为uid, 否则取data中的target
+func (r *Request) verifyTarget() (target string) {
+	if r.Session != nil && len(r.Session.Uid) > 0 && r.Session.Uid != session.GuestUid {
+		return r.Session.Uid
+	}
+	return r.DataString(RequestTagVerifyTarget)
+}
+
+// 要求有效验证码的逻辑处理单元, http与websocket通用
+// 验证码取Request.VerifyCode, 通过后作废
+func VerifyCodeRequired(purpose string, h LogicHandler) LogicHandler {
+	return func(req *Request) (res *Response) {
+		if err := session.CheckVerifyCode(req.verifyTarget(), purpose, req.VerifyCode); err != nil {
+			res = NewResponse(req)
+			res.Error = err
+			return
+		}
+		return h(req)
+	}
+}
+
+// 发送验证码的逻辑处理单元
+func VerifyCodeHandler(purpose string) LogicHandler {
+	return func(req *Request) (res *Response) {
+		res = NewResponse(req)
+		res.Error = session.IssueVerifyCode(req.verifyTarget(), purpose)
+		return
+	}
+}